@@ -3,13 +3,19 @@ module github.com/luoyecb/icurl
 go 1.15
 
 require (
-	github.com/elazarl/goproxy v0.0.0-20210801061803-8e322dfb79c4 // indirect
+	github.com/andybalholm/brotli v1.0.4
+	github.com/elazarl/goproxy v0.0.0-20210801061803-8e322dfb79c4
+	github.com/golang/protobuf v1.4.3
+	github.com/gorilla/websocket v1.5.0
+	github.com/jhump/protoreflect v1.10.1
+	github.com/klauspost/compress v1.13.6
 	github.com/luoyecb/eflag v0.1.2
 	github.com/parnurzeal/gorequest v0.2.16
 	github.com/peterh/liner v1.2.1
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/yuin/gopher-lua v0.0.0-20210529063254-f4c35e4016d9
-	golang.org/x/net v0.0.0-20210913180222-943fd674d43e // indirect
+	golang.org/x/net v0.0.0-20210913180222-943fd674d43e
+	google.golang.org/grpc v1.41.0
 	moul.io/http2curl v1.0.0 // indirect
 )
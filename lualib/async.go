@@ -0,0 +1,135 @@
+package lualib
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	BATCH_DEFAULT_CONCURRENCY = 4
+)
+
+var (
+	DefaultAsyncPool = NewAsyncPool()
+)
+
+// AsyncHandle 异步请求，请求在 goroutine 中发送，结果在 Wait 时交回 lua 虚拟机
+type AsyncHandle struct {
+	Id      int
+	Request *HttpContext
+	Entry   *HistoryEntry
+	Err     error
+	done    chan struct{}
+}
+
+func (h *AsyncHandle) Wait() {
+	<-h.done
+}
+
+// ToLTable 转换为 lua table，handle 为 send_async 返回的编号，请求失败时为 {id = handle, handle, status = 0, error}
+func (h *AsyncHandle) ToLTable(vm *lua.LState) *lua.LTable {
+	if h.Err != nil {
+		table := vm.NewTable()
+		SetLTable(table, "id", lua.LNumber(h.Id))
+		SetLTable(table, "handle", lua.LNumber(h.Id))
+		SetLTable(table, "status", lua.LNumber(0))
+		SetLTableString(table, "error", h.Err.Error())
+		return table
+	}
+	table := h.Entry.ToLTable(vm)
+	SetLTable(table, "handle", lua.LNumber(h.Id))
+	return table
+}
+
+type AsyncPool struct {
+	mu      sync.Mutex
+	handles map[int]*AsyncHandle
+	nextId  int
+}
+
+func NewAsyncPool() *AsyncPool {
+	return &AsyncPool{
+		handles: make(map[int]*AsyncHandle),
+		nextId:  1,
+	}
+}
+
+// Go 在 goroutine 中发送请求，sem 不为 nil 时用于限制并发数
+func (p *AsyncPool) Go(req *HttpContext, sem chan struct{}) *AsyncHandle {
+	p.mu.Lock()
+	h := &AsyncHandle{Id: p.nextId, Request: req, done: make(chan struct{})}
+	p.handles[h.Id] = h
+	p.nextId++
+	p.mu.Unlock()
+
+	go func() {
+		defer close(h.done)
+		if sem != nil {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+		}
+
+		resp, err := req.Do()
+		if err != nil {
+			h.Err = err
+			return
+		}
+		h.Entry = DefaultHistory.Add(req, resp)
+	}()
+	return h
+}
+
+// Take 取出 handle，取出后不能再次等待
+func (p *AsyncPool) Take(id int) (*AsyncHandle, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h, ok := p.handles[id]
+	if ok {
+		delete(p.handles, id)
+	}
+	return h, ok
+}
+
+// TakeAll 按 id 顺序取出所有 handle
+func (p *AsyncPool) TakeAll() []*AsyncHandle {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	handles := make([]*AsyncHandle, 0, len(p.handles))
+	for _, h := range p.handles {
+		handles = append(handles, h)
+	}
+	p.handles = make(map[int]*AsyncHandle)
+
+	sort.Slice(handles, func(i, j int) bool { return handles[i].Id < handles[j].Id })
+	return handles
+}
+
+// Batch 并发发送多个请求，concurrency 限制同时进行的请求数，结果与 reqs 顺序一致
+func Batch(reqs []*HttpContext, concurrency int) []*AsyncHandle {
+	if concurrency <= 0 {
+		concurrency = BATCH_DEFAULT_CONCURRENCY
+	}
+
+	sem := make(chan struct{}, concurrency)
+	pool := NewAsyncPool()
+	handles := make([]*AsyncHandle, 0, len(reqs))
+	for _, req := range reqs {
+		handles = append(handles, pool.Go(req, sem))
+	}
+	for _, h := range handles {
+		h.Wait()
+	}
+	return handles
+}
+
+func PrintAsyncHandle(h *AsyncHandle) {
+	if h.Err != nil {
+		Diagf("     %s %s error: %v\n", h.Request.Method, h.Request.buildUrl(), h.Err)
+	} else {
+		Diagf("%s\n", h.Entry)
+	}
+}
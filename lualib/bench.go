@@ -0,0 +1,381 @@
+package lualib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	BENCH_DEFAULT_N           = 100
+	BENCH_DEFAULT_CONCURRENCY = 10
+	BENCH_HISTOGRAM_BUCKETS   = 10
+	BENCH_HISTOGRAM_WIDTH     = 40
+)
+
+type BenchOptions struct {
+	N           int           // 请求总数，0 表示不限制
+	Concurrency int           // 并发数
+	Duration    time.Duration // 持续时间，0 表示不限制
+	Rate        int           // 每秒请求数，0 表示不限制
+	Output      string        // 结果输出文件，.csv 输出每个请求，.json 输出汇总
+}
+
+type BenchSample struct {
+	Start      time.Duration // 相对于压测开始的时间
+	Latency    time.Duration
+	StatusCode int
+	Error      string
+}
+
+type BenchResult struct {
+	Samples []BenchSample
+	Elapsed time.Duration
+}
+
+// BenchSummary 压测结果汇总，时间单位为毫秒
+type BenchSummary struct {
+	Total      int            `json:"total"`
+	Success    int            `json:"success"`
+	Failed     int            `json:"failed"`
+	Elapsed    float64        `json:"elapsed"`
+	Throughput float64        `json:"throughput"`
+	Min        float64        `json:"min"`
+	Mean       float64        `json:"mean"`
+	P50        float64        `json:"p50"`
+	P90        float64        `json:"p90"`
+	P99        float64        `json:"p99"`
+	Max        float64        `json:"max"`
+	Status     map[string]int `json:"status"`
+	Errors     map[string]int `json:"errors"`
+}
+
+// NewBenchTransport 压测共享的 transport，开启 keep-alive 并按并发数保留空闲连接
+func NewBenchTransport(req *HttpContext, concurrency int) *http.Transport {
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: req.DialContext(&net.Dialer{
+			Timeout:   3 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}),
+		MaxIdleConns:          concurrency * 2,
+		MaxIdleConnsPerHost:   concurrency * 2,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   3 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	req.ApplyHttpVersion(t)
+	return t
+}
+
+// Bench 按 opts 重复发送请求，n 和 duration 任意一个达到即停止
+// 直接发送请求，不经过 cassette，也不按 context.retry 重试，每个样本都是一次真实请求的延迟和结果
+func Bench(req *HttpContext, opts BenchOptions) *BenchResult {
+	if opts.N <= 0 && opts.Duration <= 0 {
+		opts.N = BENCH_DEFAULT_N
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = BENCH_DEFAULT_CONCURRENCY
+	}
+
+	req = req.Clone()
+	req.Transport = NewBenchTransport(req, opts.Concurrency)
+	defer req.Transport.CloseIdleConnections()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		count   int64
+		samples = make([]BenchSample, 0, opts.N)
+		stop    = make(chan struct{})
+		start   = time.Now()
+	)
+
+	// 限速，每个 tick 发放一个令牌
+	var tokens <-chan time.Time
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(opts.Rate))
+		defer ticker.Stop()
+		tokens = ticker.C
+	}
+	if opts.Duration > 0 {
+		timer := time.AfterFunc(opts.Duration, func() { close(stop) })
+		defer timer.Stop()
+	}
+
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if opts.N > 0 && atomic.AddInt64(&count, 1) > int64(opts.N) {
+					return
+				}
+				if tokens != nil {
+					select {
+					case <-tokens:
+					case <-stop:
+						return
+					}
+				} else {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+				}
+
+				sample := BenchSample{Start: time.Since(start)}
+				resp, err := req.do()
+				sample.Latency = time.Since(start) - sample.Start
+				if err != nil {
+					sample.Error = ErrorType(err)
+				} else {
+					sample.StatusCode = resp.StatusCode
+				}
+
+				mu.Lock()
+				samples = append(samples, sample)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return &BenchResult{Samples: samples, Elapsed: time.Since(start)}
+}
+
+// ErrorType 将请求错误归类，如 timeout、connrefused、connreset
+func ErrorType(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return "connrefused"
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return "connreset"
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "eof"
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+	var (
+		recordErr    tls.RecordHeaderError
+		authorityErr x509.UnknownAuthorityError
+		certErr      x509.CertificateInvalidError
+		hostnameErr  x509.HostnameError
+	)
+	if errors.As(err, &recordErr) || errors.As(err, &authorityErr) || errors.As(err, &certErr) || errors.As(err, &hostnameErr) {
+		return "tls"
+	}
+	return "other"
+}
+
+func (res *BenchResult) Summary() *BenchSummary {
+	sum := &BenchSummary{
+		Total:   len(res.Samples),
+		Elapsed: durationMs(res.Elapsed),
+		Status:  make(map[string]int),
+		Errors:  make(map[string]int),
+	}
+
+	latencies := make([]time.Duration, 0, len(res.Samples))
+	var total time.Duration
+	for _, sample := range res.Samples {
+		if sample.Error != "" {
+			sum.Errors[sample.Error]++
+			continue
+		}
+		sum.Status[strconv.Itoa(sample.StatusCode)]++
+		latencies = append(latencies, sample.Latency)
+		total += sample.Latency
+	}
+	sum.Success = len(latencies)
+	sum.Failed = sum.Total - sum.Success
+	if res.Elapsed > 0 {
+		sum.Throughput = float64(sum.Total) / res.Elapsed.Seconds()
+	}
+
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		sum.Min = durationMs(latencies[0])
+		sum.Mean = durationMs(total / time.Duration(len(latencies)))
+		sum.P50 = durationMs(percentile(latencies, 50))
+		sum.P90 = durationMs(percentile(latencies, 90))
+		sum.P99 = durationMs(percentile(latencies, 99))
+		sum.Max = durationMs(latencies[len(latencies)-1])
+	}
+	return sum
+}
+
+func (res *BenchResult) String() string {
+	sum := res.Summary()
+
+	var lines []string
+	lines = append(lines, fmt.Sprintf("=== Requests: %d, success: %d, failed: %d, elapsed: %.2fs, throughput: %.2f req/s",
+		sum.Total, sum.Success, sum.Failed, sum.Elapsed/1000, sum.Throughput))
+	lines = append(lines, fmt.Sprintf("=== Latency(ms): min %.2f, mean %.2f, p50 %.2f, p90 %.2f, p99 %.2f, max %.2f",
+		sum.Min, sum.Mean, sum.P50, sum.P90, sum.P99, sum.Max))
+
+	lines = append(lines, "=== Latency histogram(ms)")
+	lines = append(lines, res.histogram()...)
+
+	lines = append(lines, "=== Status code")
+	for _, k := range sortedKeys(sum.Status) {
+		lines = append(lines, fmt.Sprintf("%s = %d", k, sum.Status[k]))
+	}
+	if len(sum.Errors) > 0 {
+		lines = append(lines, "=== Errors")
+		for _, k := range sortedKeys(sum.Errors) {
+			lines = append(lines, fmt.Sprintf("%s = %d", k, sum.Errors[k]))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (res *BenchResult) histogram() []string {
+	var minLat, maxLat time.Duration = -1, 0
+	for _, sample := range res.Samples {
+		if sample.Error != "" {
+			continue
+		}
+		if minLat < 0 || sample.Latency < minLat {
+			minLat = sample.Latency
+		}
+		if sample.Latency > maxLat {
+			maxLat = sample.Latency
+		}
+	}
+	if minLat < 0 {
+		return nil
+	}
+
+	step := (maxLat - minLat) / BENCH_HISTOGRAM_BUCKETS
+	if step <= 0 {
+		step = 1
+	}
+	counts := make([]int, BENCH_HISTOGRAM_BUCKETS)
+	maxCount := 0
+	for _, sample := range res.Samples {
+		if sample.Error != "" {
+			continue
+		}
+		idx := int((sample.Latency - minLat) / step)
+		if idx >= BENCH_HISTOGRAM_BUCKETS {
+			idx = BENCH_HISTOGRAM_BUCKETS - 1
+		}
+		counts[idx]++
+		if counts[idx] > maxCount {
+			maxCount = counts[idx]
+		}
+	}
+
+	lines := make([]string, 0, BENCH_HISTOGRAM_BUCKETS)
+	for i, cnt := range counts {
+		bar := strings.Repeat("#", cnt*BENCH_HISTOGRAM_WIDTH/maxCount)
+		lines = append(lines, fmt.Sprintf("%10.2f [%6d] %s", durationMs(minLat+step*time.Duration(i+1)), cnt, bar))
+	}
+	return lines
+}
+
+// WriteFile 按扩展名输出结果，.csv 输出每个请求的明细，其他输出 json 汇总
+func (res *BenchResult) WriteFile(fpath string) error {
+	f, err := os.Create(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.ToLower(filepath.Ext(fpath)) == ".csv" {
+		w := csv.NewWriter(f)
+		w.Write([]string{"start_ms", "latency_ms", "status", "error"})
+		for _, sample := range res.Samples {
+			w.Write([]string{
+				strconv.FormatFloat(durationMs(sample.Start), 'f', 3, 64),
+				strconv.FormatFloat(durationMs(sample.Latency), 'f', 3, 64),
+				strconv.Itoa(sample.StatusCode),
+				sample.Error,
+			})
+		}
+		w.Flush()
+		return w.Error()
+	}
+
+	bytes, err := json.MarshalIndent(res.Summary(), "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(bytes)
+	return err
+}
+
+func (sum *BenchSummary) ToLTable(vm *lua.LState) *lua.LTable {
+	bytes, _ := json.Marshal(sum)
+	v, _ := ParseJson(string(bytes))
+	return JsonToLValue(vm, v).(*lua.LTable)
+}
+
+// LTableToBenchOptions 解析 bench{ n = 1000, concurrency = 20, duration = "30s", rate = 100, output = "" }
+func LTableToBenchOptions(table *lua.LTable) (BenchOptions, error) {
+	opts := BenchOptions{
+		N:           GetLTableInt(table, "n"),
+		Concurrency: GetLTableInt(table, "concurrency"),
+		Rate:        GetLTableInt(table, "rate"),
+		Output:      GetLTableString(table, "output"),
+	}
+	if s := GetLTableString(table, "duration"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return opts, err
+		}
+		opts.Duration = d
+	}
+	return opts, nil
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	idx := (len(sorted)*p+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
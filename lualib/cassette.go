@@ -0,0 +1,427 @@
+package lualib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	CASSETTE_DIR      = "cassettes"
+	CASSETTE_REDACTED = "REDACTED"
+	CASSETTE_KEY_FILE = "cassette.key" // 计算匹配字段 hmac 的 key，保存在 cassette 文件之外
+
+	CASSETTE_MODE_RECORD = "record" // 总是发送请求并记录
+	CASSETTE_MODE_REPLAY = "replay" // 只回放，不访问网络
+	CASSETTE_MODE_AUTO   = "auto"   // 有记录时回放，否则发送请求并记录
+)
+
+var (
+	DefaultCassetteMatch  = []string{"method", "url", "body"}
+	DefaultCassetteRedact = []string{
+		"Authorization",
+		"Proxy-Authorization",
+		"Cookie",
+		"Set-Cookie",
+		"X-Api-Key",
+		"access_token",
+		"api_key",
+		"password",
+		"secret",
+		"token",
+	}
+
+	activeCassette   *Cassette
+	activeCassetteMu sync.Mutex
+)
+
+type CassetteInteraction struct {
+	Request  *HttpContext
+	Response *HttpResponse
+	// Match 记录时未隐藏的匹配字段的 hmac-sha256，用于区分只有隐藏字段不同的请求
+	Match map[string]string `json:",omitempty"`
+	// MatchKey 计算 Match 的 key 的标识，与本机的 key 不同时按隐藏后的值匹配
+	MatchKey string `json:",omitempty"`
+}
+
+type CassetteOptions struct {
+	Mode            string
+	Match           []string // method|url|body|header:<name>
+	Redact          []string // header 名称，或 query、json body 中的 key，不区分大小写，总是包含 DefaultCassetteRedact
+	NoDefaultRedact bool     // 不隐藏 DefaultCassetteRedact 中的字段
+}
+
+// Cassette 记录请求和响应到 ~/.icurl/cassettes/<name>.json，之后可以离线回放
+type Cassette struct {
+	Name  string
+	fpath string
+	opts  CassetteOptions
+
+	mu           sync.Mutex
+	Interactions []*CassetteInteraction
+	cursors      map[string]int
+
+	key   []byte
+	keyId string
+}
+
+func OpenCassette(name string, opts CassetteOptions) (*Cassette, error) {
+	switch opts.Mode {
+	case "":
+		opts.Mode = CASSETTE_MODE_AUTO
+	case CASSETTE_MODE_RECORD, CASSETTE_MODE_REPLAY, CASSETTE_MODE_AUTO:
+	default:
+		return nil, fmt.Errorf("invalid cassette mode %s, need record|replay|auto", opts.Mode)
+	}
+	if len(opts.Match) == 0 {
+		opts.Match = DefaultCassetteMatch
+	}
+	if !opts.NoDefaultRedact {
+		opts.Redact = append(append([]string{}, DefaultCassetteRedact...), opts.Redact...)
+	}
+
+	c := &Cassette{
+		Name:         name,
+		fpath:        GetRealPath(filepath.Join(GetBasePath(), CASSETTE_DIR, name+".json")),
+		opts:         opts,
+		Interactions: make([]*CassetteInteraction, 0),
+		cursors:      make(map[string]int),
+	}
+	if err := c.loadKey(); err != nil {
+		return nil, fmt.Errorf("cassette key: %v", err)
+	}
+
+	if FileExists(c.fpath) && opts.Mode != CASSETTE_MODE_RECORD {
+		content, err := ioutil.ReadFile(c.fpath)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(content, &c.Interactions); err != nil {
+			return nil, fmt.Errorf("cassette %s: %v", name, err)
+		}
+	} else if opts.Mode == CASSETTE_MODE_REPLAY {
+		return nil, fmt.Errorf("cassette %s not exists", name)
+	}
+	return c, nil
+}
+
+func UseCassette(c *Cassette) {
+	activeCassetteMu.Lock()
+	defer activeCassetteMu.Unlock()
+
+	activeCassette = c
+}
+
+func GetCassette() *Cassette {
+	activeCassetteMu.Lock()
+	defer activeCassetteMu.Unlock()
+
+	return activeCassette
+}
+
+func (c *Cassette) Mode() string {
+	return c.opts.Mode
+}
+
+// Do 根据模式回放或发送请求，使用未隐藏的请求匹配记录
+func (c *Cassette) Do(req *HttpContext) (*HttpResponse, error) {
+	redacted := c.redactRequest(req)
+
+	if c.opts.Mode != CASSETTE_MODE_RECORD {
+		if resp, ok := c.replay(req, redacted); ok {
+			return resp, nil
+		}
+		if c.opts.Mode == CASSETTE_MODE_REPLAY {
+			return nil, fmt.Errorf("cassette %s: no recorded interaction for %s %s", c.Name, strings.ToUpper(req.Method), redacted.buildUrl())
+		}
+	}
+
+	resp, err := req.do()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.record(req, redacted, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// replay 按记录顺序回放相同请求的响应，用完后重复最后一个
+func (c *Cassette) replay(req, redacted *HttpContext) (*HttpResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hashes := c.matchHashes(req)
+	values := c.matchValues(redacted)
+	key := strings.Join(mapValues(hashes, c.opts.Match), "\n")
+
+	matched := make([]*CassetteInteraction, 0)
+	for _, it := range c.Interactions {
+		if c.matches(it, hashes, values) {
+			matched = append(matched, it)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, false
+	}
+
+	idx := c.cursors[key]
+	if idx >= len(matched) {
+		idx = len(matched) - 1
+	}
+	c.cursors[key] = idx + 1
+
+	resp := *matched[idx].Response
+	resp.Replayed = true
+	return &resp, true
+}
+
+func (c *Cassette) record(req, redacted *HttpContext, resp *HttpResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	saved := *resp
+	saved.Header = c.redactHeader(resp.Header)
+	saved.Body = c.redactBody(resp.Body)
+	c.Interactions = append(c.Interactions, &CassetteInteraction{
+		Request:  redacted,
+		Response: &saved,
+		Match:    c.matchHashes(req),
+		MatchKey: c.keyId,
+	})
+
+	bytes, err := json.MarshalIndent(c.Interactions, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.fpath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.fpath, bytes, 0600)
+}
+
+// matches 优先比较记录时未隐藏的值的 hmac，没有记录或 key 不同时比较隐藏后的值
+func (c *Cassette) matches(it *CassetteInteraction, hashes, values map[string]string) bool {
+	var recorded map[string]string
+	for _, m := range c.opts.Match {
+		if h, ok := it.Match[m]; ok && it.MatchKey == c.keyId {
+			if h != hashes[m] {
+				return false
+			}
+			continue
+		}
+		if recorded == nil {
+			recorded = c.matchValues(it.Request)
+		}
+		if recorded[m] != values[m] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Cassette) matchValues(req *HttpContext) map[string]string {
+	values := make(map[string]string, len(c.opts.Match))
+	for _, m := range c.opts.Match {
+		switch {
+		case m == "method":
+			values[m] = strings.ToUpper(req.Method)
+		case m == "url":
+			values[m] = req.buildUrl()
+		case m == "body":
+			values[m], _ = req.Body()
+		case strings.HasPrefix(m, "header:"):
+			name := m[len("header:"):]
+			parts := make([]string, 0)
+			for _, p := range req.Header {
+				if strings.EqualFold(p.Key, name) {
+					parts = append(parts, p.Value)
+				}
+			}
+			values[m] = strings.Join(parts, "\n")
+		}
+	}
+	return values
+}
+
+// matchHashes 未隐藏的匹配字段的 hmac-sha256，cassette 文件中不保存原始值
+// 使用 cassette 文件之外的 key，避免从文件中的 hash 猜出简单的 token
+func (c *Cassette) matchHashes(req *HttpContext) map[string]string {
+	hashes := c.matchValues(req)
+	for m, v := range hashes {
+		hashes[m] = c.hmac(v)
+	}
+	return hashes
+}
+
+func (c *Cassette) hmac(v string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(v))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// loadKey 读取 ~/.icurl/cassette.key，不存在时随机生成
+func (c *Cassette) loadKey() error {
+	fpath := GetRealPath(filepath.Join(GetBasePath(), CASSETTE_KEY_FILE))
+	if FileExists(fpath) {
+		content, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			return err
+		}
+		if c.key, err = hex.DecodeString(strings.TrimSpace(string(content))); err != nil {
+			return err
+		}
+	} else {
+		c.key = make([]byte, 32)
+		if _, err := rand.Read(c.key); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(fpath), 0700); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(fpath, []byte(hex.EncodeToString(c.key)+"\n"), 0600); err != nil {
+			return err
+		}
+	}
+	c.keyId = c.hmac("icurl cassette key")[:16]
+	return nil
+}
+
+func mapValues(m map[string]string, keys []string) []string {
+	res := make([]string, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, m[k])
+	}
+	return res
+}
+
+func (c *Cassette) isRedacted(name string) bool {
+	for _, r := range c.opts.Redact {
+		if strings.EqualFold(r, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cassette) redactRequest(req *HttpContext) *HttpContext {
+	redacted := req.Clone()
+	redacted.Transport = nil
+	for i, p := range redacted.Header {
+		if c.isRedacted(p.Key) {
+			redacted.Header[i].Value = CASSETTE_REDACTED
+		}
+	}
+	for i, p := range redacted.Query {
+		if c.isRedacted(p.Key) {
+			redacted.Query[i].Value = CASSETTE_REDACTED
+		}
+	}
+	if u, err := url.Parse(redacted.Url); err == nil && u.RawQuery != "" {
+		query := u.Query()
+		for k := range query {
+			if c.isRedacted(k) {
+				query.Set(k, CASSETTE_REDACTED)
+			}
+		}
+		u.RawQuery = query.Encode()
+		redacted.Url = u.String()
+	}
+	redacted.Data = c.redactBody(redacted.Data)
+	redacted.Json = c.redactBody(redacted.Json)
+	for i, p := range redacted.Form {
+		if c.isRedacted(p.Key) {
+			redacted.Form[i].Value = CASSETTE_REDACTED
+		}
+	}
+	return redacted
+}
+
+func (c *Cassette) redactHeader(header http.Header) http.Header {
+	res := make(http.Header, len(header))
+	for k, v := range header {
+		if c.isRedacted(k) {
+			res[k] = []string{CASSETTE_REDACTED}
+		} else {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// redactBody 替换 json 或 urlencoded body 中需要隐藏的字段
+func (c *Cassette) redactBody(body string) string {
+	if v, ok := ParseJson(body); ok {
+		if c.redactJson(v) {
+			if bytes, err := json.Marshal(v); err == nil {
+				return string(bytes)
+			}
+		}
+		return body
+	}
+
+	if strings.Contains(body, "=") && !strings.ContainsAny(body, " \n{") {
+		if values, err := url.ParseQuery(body); err == nil {
+			changed := false
+			for k := range values {
+				if c.isRedacted(k) {
+					values.Set(k, CASSETTE_REDACTED)
+					changed = true
+				}
+			}
+			if changed {
+				return values.Encode()
+			}
+		}
+	}
+	return body
+}
+
+func (c *Cassette) redactJson(v interface{}) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if c.isRedacted(k) {
+				v[k] = CASSETTE_REDACTED
+				changed = true
+			} else if c.redactJson(item) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if c.redactJson(item) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// LTableToCassetteOptions 解析 {mode = "auto", match = {"method", "url"}, redact = {"Authorization"}, redact_defaults = true}
+func LTableToCassetteOptions(table *lua.LTable) CassetteOptions {
+	opts := CassetteOptions{
+		Mode:            GetLTableString(table, "mode"),
+		NoDefaultRedact: table.RawGetString("redact_defaults") == lua.LFalse,
+	}
+	if t := GetLTableTable(table, "match"); t != nil {
+		opts.Match = LTableToStringSlice(t)
+	}
+	if t := GetLTableTable(table, "redact"); t != nil {
+		opts.Redact = LTableToStringSlice(t)
+	}
+	return opts
+}
@@ -0,0 +1,255 @@
+package lualib
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+)
+
+var (
+	// 默认忽略的易变字段，header 名称不区分大小写
+	DefaultCompareIgnore = []string{
+		"Date",
+		"X-Request-Id",
+		"X-Trace-Id",
+		"Retry-Count",
+		"timestamp",
+		"request_id",
+		"requestId",
+		"trace_id",
+		"traceId",
+	}
+)
+
+type CompareResult struct {
+	A, B       *HistoryEntry
+	StatusDiff bool
+	HeaderDiff []DiffItem
+	BodyDiff   []DiffItem
+}
+
+func (res *CompareResult) Same() bool {
+	return !res.StatusDiff && len(res.HeaderDiff) == 0 && len(res.BodyDiff) == 0
+}
+
+func (res *CompareResult) String() string {
+	var lines []string
+
+	lines = append(lines, fmt.Sprintf("=== A: %s", res.A))
+	lines = append(lines, fmt.Sprintf("=== B: %s", res.B))
+	if res.StatusDiff {
+		lines = append(lines, fmt.Sprintf("~ status: %d => %d", res.A.Response.StatusCode, res.B.Response.StatusCode))
+	}
+	for _, item := range res.HeaderDiff {
+		lines = append(lines, item.String())
+	}
+	for _, item := range res.BodyDiff {
+		lines = append(lines, item.String())
+	}
+	if res.Same() {
+		lines = append(lines, "no difference")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Compare 将同一个请求并发发送到两个环境，并比较 status、header 和 json body，调用方需要持有虚拟机锁
+// env 可以是 base url，如 http://127.0.0.1:8080，也可以是 ~/.icurl/env/ 下的环境名
+func Compare(vm *lua.LState, ctx *lua.LTable, envA, envB string, ignore []string) (*CompareResult, error) {
+	reqA, err := compareHttpContext(vm, ctx, envA)
+	if err != nil {
+		return nil, err
+	}
+	reqB, err := compareHttpContext(vm, ctx, envB)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		wg           sync.WaitGroup
+		respA, respB *HttpResponse
+		errA, errB   error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		respA, errA = reqA.Do()
+	}()
+	go func() {
+		defer wg.Done()
+		respB, errB = reqB.Do()
+	}()
+	Unblock(wg.Wait)
+
+	if errA != nil {
+		return nil, fmt.Errorf("%s: %v", envA, errA)
+	}
+	if errB != nil {
+		return nil, fmt.Errorf("%s: %v", envB, errB)
+	}
+
+	ignore = append(append([]string{}, DefaultCompareIgnore...), ignore...)
+	return &CompareResult{
+		A:          DefaultHistory.Add(reqA, respA),
+		B:          DefaultHistory.Add(reqB, respB),
+		StatusDiff: respA.StatusCode != respB.StatusCode,
+		HeaderDiff: diffHeader(respA.Header, respB.Header, ignore),
+		BodyDiff:   FilterDiffItems(DiffBody(respA.Body, respB.Body), ignore),
+	}, nil
+}
+
+// LoadEnvVars 在独立的 lua 虚拟机中执行 ~/.icurl/env/<name>.lua，返回其中的 vars
+func LoadEnvVars(name string) (map[string]string, error) {
+	fpath := GetRealPath(filepath.Join(GetBasePath(), ENV_DIR, name+".lua"))
+	if !FileExists(fpath) {
+		return nil, fmt.Errorf("env %s not exists", name)
+	}
+
+	vm := lua.NewState()
+	defer vm.Close()
+
+	if err := RunLuaCode(vm, INIT_VARS_CODE); err != nil {
+		return nil, err
+	}
+	if err := RunLuaFile(vm, fpath); err != nil {
+		return nil, err
+	}
+	return GetVars(vm), nil
+}
+
+// RebaseUrl 将 rawurl 的 scheme 和 host 替换为 base 的，base 的 path 作为前缀
+func RebaseUrl(rawurl, base string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	if b.Scheme == "" || b.Host == "" {
+		return "", fmt.Errorf("invalid base url %s", base)
+	}
+
+	u.Scheme = b.Scheme
+	u.Host = b.Host
+	u.Path = strings.TrimRight(b.Path, "/") + u.Path
+	return u.String(), nil
+}
+
+func compareHttpContext(vm *lua.LState, ctx *lua.LTable, env string) (*HttpContext, error) {
+	if env == "" {
+		return nil, errors.New("env must not be empty")
+	}
+
+	if strings.Contains(env, "://") {
+		httpCtx, err := ContextToHttpContext(ctx, GetVars(vm))
+		if err != nil {
+			return nil, err
+		}
+		rebased, err := RebaseUrl(httpCtx.Url, env)
+		if err != nil {
+			return nil, err
+		}
+		httpCtx.Url = rebased
+		return httpCtx, nil
+	}
+
+	envVars, err := LoadEnvVars(env)
+	if err != nil {
+		return nil, err
+	}
+	vars := GetVars(vm)
+	for k, v := range envVars {
+		vars[k] = v
+	}
+	return ContextToHttpContext(ctx, vars)
+}
+
+func diffHeader(a, b http.Header, ignore []string) []DiffItem {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	items := make([]DiffItem, 0)
+	for _, k := range keys {
+		if matchIgnoreHeader(k, ignore) {
+			continue
+		}
+
+		path := "header " + k
+		va, inA := a[k]
+		vb, inB := b[k]
+		if !inB {
+			items = append(items, DiffItem{Op: DIFF_DEL, Path: path, Old: strings.Join(va, ", ")})
+		} else if !inA {
+			items = append(items, DiffItem{Op: DIFF_ADD, Path: path, New: strings.Join(vb, ", ")})
+		} else if strings.Join(va, ", ") != strings.Join(vb, ", ") {
+			items = append(items, DiffItem{Op: DIFF_CHANGE, Path: path, Old: strings.Join(va, ", "), New: strings.Join(vb, ", ")})
+		}
+	}
+	return items
+}
+
+func matchIgnoreHeader(name string, ignore []string) bool {
+	for _, rule := range ignore {
+		if rule != "" && strings.EqualFold(name, rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterDiffItems 过滤忽略的字段
+// 以 $ 开头的规则匹配 json 路径及其子路径，* 匹配单个 key 或下标，如 $.data[*].updated_at
+// 其他规则匹配任意层级的 key，如 timestamp
+func FilterDiffItems(items []DiffItem, ignore []string) []DiffItem {
+	if len(ignore) == 0 {
+		return items
+	}
+
+	rules := make([]*regexp.Regexp, 0, len(ignore))
+	for _, rule := range ignore {
+		if rule != "" {
+			rules = append(rules, compileIgnoreRule(rule))
+		}
+	}
+
+	res := make([]DiffItem, 0, len(items))
+	for _, item := range items {
+		ignored := false
+		for _, rule := range rules {
+			if rule.MatchString(item.Path) {
+				ignored = true
+				break
+			}
+		}
+		if !ignored {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+func compileIgnoreRule(rule string) *regexp.Regexp {
+	if strings.HasPrefix(rule, "$") {
+		pattern := strings.Replace(regexp.QuoteMeta(rule), `\*`, `[^.\[\]]*`, -1)
+		return regexp.MustCompile("^" + pattern + `($|[.\[])`)
+	}
+	key := regexp.QuoteMeta(rule)
+	return regexp.MustCompile(`(\.` + key + `|\["` + key + `"\])($|[.\[])`)
+}
@@ -0,0 +1,78 @@
+package lualib
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	ACCEPT_ENCODING = "gzip, deflate, br, zstd"
+)
+
+// DecodeContentEncoding 按 Content-Encoding 解压 body，多个编码按相反顺序解压
+func DecodeContentEncoding(encoding string, body []byte) ([]byte, error) {
+	encodings := strings.Split(encoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		enc := strings.ToLower(strings.TrimSpace(encodings[i]))
+		if enc == "" || enc == "identity" {
+			continue
+		}
+
+		r, err := newDecoder(enc, body)
+		if err != nil {
+			return nil, fmt.Errorf("decode %s: %v", enc, err)
+		}
+		decoded, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decode %s: %v", enc, err)
+		}
+		body = decoded
+	}
+	return body, nil
+}
+
+func newDecoder(encoding string, body []byte) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// deflate 应为 zlib 格式，部分服务端直接返回 raw deflate
+		if r, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			return r, nil
+		}
+		return flate.NewReader(bytes.NewReader(body)), nil
+	case "br":
+		return ioutil.NopCloser(brotli.NewReader(bytes.NewReader(body))), nil
+	case "zstd":
+		r, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		return r.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding")
+	}
+}
+
+// GzipString 压缩请求 body
+func GzipString(s string) (string, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
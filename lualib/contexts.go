@@ -0,0 +1,245 @@
+package lualib
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	DEFAULT_CONTEXT = "default"
+)
+
+var (
+	// 命名的 context，当前使用的 context 保存在全局变量 context 中，切换时才写回
+	namedContexts = map[string]*lua.LTable{}
+	activeContext = DEFAULT_CONTEXT
+	// 嵌套的 with_context/send_lua 层数，其中切换的 context 会在结束时被恢复，因此不允许切换
+	withContextDepth = 0
+)
+
+// ActiveContext 返回当前使用的 context 名字
+func ActiveContext() string {
+	return activeContext
+}
+
+// LookupContext 按名字查找 context，当前使用的 context 返回全局变量 context
+func LookupContext(vm *lua.LState, name string) (*lua.LTable, bool) {
+	if name == activeContext {
+		return GetContext(vm)
+	}
+	ctx, ok := namedContexts[name]
+	return ctx, ok
+}
+
+// switchContext 保存当前的 context 并切换到 name，ctx 为 nil 时使用 InitContext 初始化
+func switchContext(vm *lua.LState, name string, ctx *lua.LTable) error {
+	if withContextDepth > 0 {
+		return errors.New("can not switch context inside with_context or send_lua")
+	}
+	cur, ok := GetContext(vm)
+	if !ok {
+		return errors.New("context must be table")
+	}
+	namedContexts[activeContext] = cur
+	if ctx == nil {
+		if err := InitContext(vm); err != nil {
+			vm.SetGlobal("context", cur)
+			delete(namedContexts, activeContext)
+			return err
+		}
+	} else {
+		vm.SetGlobal("context", ctx)
+	}
+	activeContext = name
+	delete(namedContexts, name)
+	return nil
+}
+
+// ctx_new(name, [table]) 新建 context 并切换过去，默认与启动时的 context 相同，table 参数作为初始值
+func ctx_new(vm *lua.LState) int {
+	name := vm.CheckString(1)
+	if _, ok := LookupContext(vm, name); ok {
+		vm.RaiseError("context %s exists", name)
+		return 1
+	}
+	var ctx *lua.LTable
+	if t := vm.OptTable(2, nil); t != nil {
+		ctx = CopyLTable(vm, t)
+	}
+	if err := switchContext(vm, name, ctx); err != nil {
+		vm.RaiseError("ctx_new error: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func ctx_use(vm *lua.LState) int {
+	name := vm.CheckString(1)
+	if name == activeContext {
+		return 0
+	}
+	ctx, ok := namedContexts[name]
+	if !ok {
+		vm.RaiseError("context %s not exists", name)
+		return 1
+	}
+	if err := switchContext(vm, name, ctx); err != nil {
+		vm.RaiseError("ctx_use error: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// ctx_list() 按名字排序输出所有 context，当前使用的以 * 标记
+func ctx_list(vm *lua.LState) int {
+	names := []string{activeContext}
+	for name := range namedContexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mark := " "
+		if name == activeContext {
+			mark = "*"
+		}
+		ctx, _ := LookupContext(vm, name)
+		line := fmt.Sprintf("%s %s\t%s %s", mark, name, GetLTableString(ctx, "method", "GET"), GetLTableString(ctx, "url", ""))
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+	return 0
+}
+
+// ctx_copy(from, to) 深拷贝 context，to 不存在时新建，存在时覆盖
+func ctx_copy(vm *lua.LState) int {
+	from := vm.CheckString(1)
+	to := vm.CheckString(2)
+	ctx, ok := LookupContext(vm, from)
+	if !ok {
+		vm.RaiseError("context %s not exists", from)
+		return 1
+	}
+	if to == activeContext {
+		if withContextDepth > 0 {
+			vm.RaiseError("can not replace active context inside with_context or send_lua")
+			return 1
+		}
+		vm.SetGlobal("context", CopyLTable(vm, ctx))
+	} else {
+		namedContexts[to] = CopyLTable(vm, ctx)
+	}
+	return 0
+}
+
+// CheckGetContextArg 获取第 n 个参数指定的 context，可以是名字或 table，其他类型返回 nil
+func CheckGetContextArg(vm *lua.LState, n int) (*lua.LTable, bool) {
+	return lookupContextValue(vm, vm.Get(n))
+}
+
+// CheckGetContextOpt 获取选项 table 中 context 字段指定的 context，可以是名字或 table，没有指定时使用当前的 context
+func CheckGetContextOpt(vm *lua.LState, opts *lua.LTable) (*lua.LTable, bool) {
+	if opts == nil {
+		return CheckGetContext(vm)
+	}
+	v := opts.RawGetString("context")
+	switch v.(type) {
+	case *lua.LNilType:
+		return CheckGetContext(vm)
+	case *lua.LTable, lua.LString:
+		return lookupContextValue(vm, v)
+	}
+	vm.RaiseError("context option must be context name or table")
+	return nil, false
+}
+
+func lookupContextValue(vm *lua.LState, v lua.LValue) (*lua.LTable, bool) {
+	switch v := v.(type) {
+	case *lua.LTable:
+		return v, true
+	case lua.LString:
+		ctx, ok := LookupContext(vm, string(v))
+		if !ok {
+			vm.RaiseError("context %s not exists", string(v))
+			return nil, false
+		}
+		return ctx, true
+	}
+	return nil, true
+}
+
+// CopyLTable 深拷贝 table，保留 json.array()/json.object() 等 metatable
+func CopyLTable(vm *lua.LState, t *lua.LTable) *lua.LTable {
+	return copyLTable(vm, t, make(map[*lua.LTable]*lua.LTable))
+}
+
+func copyLTable(vm *lua.LState, t *lua.LTable, copied map[*lua.LTable]*lua.LTable) *lua.LTable {
+	if c, ok := copied[t]; ok {
+		return c
+	}
+	c := vm.NewTable()
+	copied[t] = c
+	ForEachOrdered(t, func(k, v lua.LValue) {
+		if vt, ok := v.(*lua.LTable); ok {
+			v = copyLTable(vm, vt, copied)
+		}
+		c.RawSet(k, v)
+	})
+	c.Metatable = t.Metatable
+	return c
+}
+
+// WithContext 使用 context 的副本执行 fn，overrides 中的字段替换副本中的同名字段
+// fn 中对 context 的修改和重新赋值都不会保留，fn 出错时也会恢复原来的 context
+func WithContext(vm *lua.LState, overrides *lua.LTable, fn func()) {
+	orig, ok := CheckGetContext(vm)
+	if !ok {
+		return
+	}
+	ctx := CopyLTable(vm, orig)
+	if overrides != nil {
+		ForEachOrdered(overrides, func(k, v lua.LValue) {
+			if vt, ok := v.(*lua.LTable); ok {
+				v = CopyLTable(vm, vt)
+			}
+			ctx.RawSet(k, v)
+		})
+	}
+
+	useContext(vm, ctx, orig, fn)
+}
+
+// useContext 将全局变量 context 设为 ctx 执行 fn，结束后恢复为 orig，fn 中不能切换命名的 context
+func useContext(vm *lua.LState, ctx *lua.LTable, orig lua.LValue, fn func()) {
+	vm.SetGlobal("context", ctx)
+	withContextDepth++
+	defer func() {
+		withContextDepth--
+		vm.SetGlobal("context", orig)
+	}()
+	fn()
+}
+
+// with_context(overrides|name, fn) 使用临时修改的 context 或命名 context 的副本执行 fn，返回 fn 的返回值
+func with_context(vm *lua.LState) int {
+	fn := vm.CheckFunction(2)
+	call := func() {
+		vm.Push(fn)
+		vm.Call(0, lua.MultRet)
+	}
+
+	base := vm.GetTop()
+	if name, ok := vm.Get(1).(lua.LString); ok {
+		ctx, ok := LookupContext(vm, string(name))
+		if !ok {
+			vm.RaiseError("context %s not exists", string(name))
+			return 0
+		}
+		useContext(vm, CopyLTable(vm, ctx), vm.GetGlobal("context"), call)
+	} else {
+		WithContext(vm, vm.CheckTable(1), call)
+	}
+	return vm.GetTop() - base
+}
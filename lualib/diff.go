@@ -0,0 +1,136 @@
+package lualib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+const (
+	DIFF_ADD    = '+'
+	DIFF_DEL    = '-'
+	DIFF_CHANGE = '~'
+)
+
+type DiffItem struct {
+	Op   byte
+	Path string
+	Old  interface{}
+	New  interface{}
+}
+
+func (item DiffItem) String() string {
+	switch item.Op {
+	case DIFF_ADD:
+		return fmt.Sprintf("%c %s: %s", item.Op, item.Path, diffValueString(item.New))
+	case DIFF_DEL:
+		return fmt.Sprintf("%c %s: %s", item.Op, item.Path, diffValueString(item.Old))
+	default:
+		return fmt.Sprintf("%c %s: %s => %s", item.Op, item.Path, diffValueString(item.Old), diffValueString(item.New))
+	}
+}
+
+// ParseJson 解析 json 字符串，数字保持原样，避免大整数丢失精度
+func ParseJson(s string) (interface{}, bool) {
+	var holder interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(s)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&holder); err != nil {
+		return nil, false
+	}
+	if decoder.More() {
+		return nil, false
+	}
+	return holder, true
+}
+
+// DiffBody 比较两个响应体，都是 json 时按结构比较，否则按字符串比较
+func DiffBody(a, b string) []DiffItem {
+	ja, oka := ParseJson(a)
+	jb, okb := ParseJson(b)
+	if !oka || !okb {
+		ja, jb = a, b
+	}
+	return JsonDiff(ja, jb)
+}
+
+func JsonDiff(a, b interface{}) []DiffItem {
+	items := make([]DiffItem, 0)
+	jsonDiff("$", a, b, &items)
+	return items
+}
+
+func jsonDiff(path string, a, b interface{}, items *[]DiffItem) {
+	switch va := a.(type) {
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(va)+len(vb))
+		for k := range va {
+			keys = append(keys, k)
+		}
+		for k := range vb {
+			if _, ok := va[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			subpath := JsonPathKey(path, k)
+			oldVal, inA := va[k]
+			newVal, inB := vb[k]
+			if !inB {
+				*items = append(*items, DiffItem{Op: DIFF_DEL, Path: subpath, Old: oldVal})
+			} else if !inA {
+				*items = append(*items, DiffItem{Op: DIFF_ADD, Path: subpath, New: newVal})
+			} else {
+				jsonDiff(subpath, oldVal, newVal, items)
+			}
+		}
+		return
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+
+		for i := 0; i < len(va) || i < len(vb); i++ {
+			subpath := path + "[" + strconv.Itoa(i) + "]"
+			if i >= len(vb) {
+				*items = append(*items, DiffItem{Op: DIFF_DEL, Path: subpath, Old: va[i]})
+			} else if i >= len(va) {
+				*items = append(*items, DiffItem{Op: DIFF_ADD, Path: subpath, New: vb[i]})
+			} else {
+				jsonDiff(subpath, va[i], vb[i], items)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		*items = append(*items, DiffItem{Op: DIFF_CHANGE, Path: path, Old: a, New: b})
+	}
+}
+
+func JsonPathKey(path, key string) string {
+	if key != "" && StringIsIdent(key) {
+		return path + "." + key
+	}
+	return path + "[" + strconv.Quote(key) + "]"
+}
+
+func diffValueString(v interface{}) string {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(bytes)
+}
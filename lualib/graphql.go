@@ -0,0 +1,484 @@
+package lualib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	GRAPHQL_DIR = "graphql"
+
+	GRAPHQL_INTROSPECTION_QUERY = `query IntrospectionQuery {
+  __schema {
+    queryType { name }
+    mutationType { name }
+    subscriptionType { name }
+    types {
+      kind
+      name
+      fields(includeDeprecated: true) {
+        name
+        args { name }
+        type { kind name ofType { kind name ofType { kind name ofType { kind name } } } }
+      }
+      inputFields { name }
+      enumValues(includeDeprecated: true) { name }
+    }
+  }
+}`
+
+	// graphql-ws 子协议，前者为新协议 graphql-transport-ws，后者为 subscriptions-transport-ws
+	GRAPHQL_WS_PROTOCOL        = "graphql-transport-ws"
+	GRAPHQL_WS_LEGACY_PROTOCOL = "graphql-ws"
+)
+
+var (
+	graphqlOperationRegexp      = regexp.MustCompile(`^\s*(query|mutation|subscription)\b`)
+	graphqlNamedOperationRegexp = regexp.MustCompile(`\b(query|mutation|subscription)\s+([_A-Za-z][_0-9A-Za-z]*)`)
+	graphqlSchemaNameRegexp     = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+	graphqlSchemas   = make(map[string]*GraphqlSchema)
+	graphqlSchemasMu sync.Mutex
+)
+
+type GraphqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+	OperationName string                 `json:"operationName,omitempty"`
+}
+
+type GraphqlError struct {
+	Message   string        `json:"message"`
+	Path      []interface{} `json:"path,omitempty"`
+	Locations []struct {
+		Line   int `json:"line"`
+		Column int `json:"column"`
+	} `json:"locations,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+func (e *GraphqlError) String() string {
+	var buf strings.Builder
+	buf.WriteString(e.Message)
+	if len(e.Path) > 0 {
+		path := make([]string, 0, len(e.Path))
+		for _, p := range e.Path {
+			path = append(path, fmt.Sprint(p))
+		}
+		buf.WriteString(", path: " + strings.Join(path, "."))
+	}
+	for _, loc := range e.Locations {
+		buf.WriteString(fmt.Sprintf(", at %d:%d", loc.Line, loc.Column))
+	}
+	if code, ok := e.Extensions["code"]; ok {
+		buf.WriteString(fmt.Sprintf(", code: %v", code))
+	}
+	return buf.String()
+}
+
+type GraphqlResponse struct {
+	Data       json.RawMessage        `json:"data"`
+	Errors     []*GraphqlError        `json:"errors"`
+	Extensions map[string]interface{} `json:"extensions"`
+}
+
+// Print data 输出到 stdout，标题和 errors 输出到 stderr
+func (resp *GraphqlResponse) Print(formatJson bool) {
+	if len(resp.Data) > 0 && string(resp.Data) != "null" {
+		Diagf("=== Data:\n")
+		PrintOutputBody(string(resp.Data), formatJson)
+	}
+	if len(resp.Errors) > 0 {
+		Diagf("=== Errors:\n")
+		for _, e := range resp.Errors {
+			fmt.Fprintln(os.Stderr, "- "+e.String())
+		}
+	}
+}
+
+// GraphqlOperationType 返回 query|mutation|subscription，省略关键字的简写形式为 query
+func GraphqlOperationType(query, operation string) string {
+	if operation != "" {
+		for _, m := range graphqlNamedOperationRegexp.FindAllStringSubmatch(query, -1) {
+			if m[2] == operation {
+				return m[1]
+			}
+		}
+	}
+	if m := graphqlOperationRegexp.FindStringSubmatch(stripGraphqlComments(query)); m != nil {
+		return m[1]
+	}
+	return "query"
+}
+
+func stripGraphqlComments(query string) string {
+	lines := strings.Split(query, "\n")
+	for i, line := range lines {
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			lines[i] = line[:idx]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// NewGraphqlHttpContext 根据 context 构造 POST 请求，body 为 {"query", "variables", "operationName"}
+func NewGraphqlHttpContext(req *HttpContext, gql *GraphqlRequest) (*HttpContext, error) {
+	body, err := json.Marshal(gql)
+	if err != nil {
+		return nil, err
+	}
+
+	httpCtx := req.Clone()
+	httpCtx.Method = "POST"
+	httpCtx.Data = string(body)
+	httpCtx.Header.SetFold("Content-Type", "application/json")
+	if !httpCtx.Header.HasFold("Accept") {
+		httpCtx.Header.Add("Accept", "application/json")
+	}
+	return httpCtx, nil
+}
+
+func ParseGraphqlResponse(body string) (*GraphqlResponse, error) {
+	resp := &GraphqlResponse{}
+	if err := json.Unmarshal([]byte(body), resp); err != nil {
+		return nil, fmt.Errorf("invalid graphql response: %v", err)
+	}
+	return resp, nil
+}
+
+type GraphqlTypeRef struct {
+	Kind   string          `json:"kind"`
+	Name   string          `json:"name"`
+	OfType *GraphqlTypeRef `json:"ofType"`
+}
+
+func (t *GraphqlTypeRef) String() string {
+	if t == nil {
+		return ""
+	}
+	switch t.Kind {
+	case "NON_NULL":
+		return t.OfType.String() + "!"
+	case "LIST":
+		return "[" + t.OfType.String() + "]"
+	default:
+		return t.Name
+	}
+}
+
+type GraphqlField struct {
+	Name string `json:"name"`
+	Args []struct {
+		Name string `json:"name"`
+	} `json:"args"`
+	Type *GraphqlTypeRef `json:"type"`
+}
+
+type GraphqlType struct {
+	Kind        string          `json:"kind"`
+	Name        string          `json:"name"`
+	Fields      []*GraphqlField `json:"fields"`
+	InputFields []struct {
+		Name string `json:"name"`
+	} `json:"inputFields"`
+	EnumValues []struct {
+		Name string `json:"name"`
+	} `json:"enumValues"`
+}
+
+type GraphqlSchema struct {
+	QueryType        *struct{ Name string } `json:"queryType"`
+	MutationType     *struct{ Name string } `json:"mutationType"`
+	SubscriptionType *struct{ Name string } `json:"subscriptionType"`
+	Types            []*GraphqlType         `json:"types"`
+}
+
+// String 按 SDL 的简化形式输出，忽略内置类型
+func (s *GraphqlSchema) String() string {
+	var buf strings.Builder
+	for _, t := range s.Types {
+		if strings.HasPrefix(t.Name, "__") || t.Kind == "SCALAR" {
+			continue
+		}
+		switch t.Kind {
+		case "OBJECT", "INTERFACE":
+			fields := make([]string, 0, len(t.Fields))
+			for _, f := range t.Fields {
+				fields = append(fields, f.Name+": "+f.Type.String())
+			}
+			buf.WriteString(fmt.Sprintf("%s %s { %s }\n", strings.ToLower(t.Kind), t.Name, strings.Join(fields, ", ")))
+		case "INPUT_OBJECT":
+			fields := make([]string, 0, len(t.InputFields))
+			for _, f := range t.InputFields {
+				fields = append(fields, f.Name)
+			}
+			buf.WriteString(fmt.Sprintf("input %s { %s }\n", t.Name, strings.Join(fields, ", ")))
+		case "ENUM":
+			values := make([]string, 0, len(t.EnumValues))
+			for _, v := range t.EnumValues {
+				values = append(values, v.Name)
+			}
+			buf.WriteString(fmt.Sprintf("enum %s { %s }\n", t.Name, strings.Join(values, ", ")))
+		default:
+			buf.WriteString(fmt.Sprintf("%s %s\n", strings.ToLower(t.Kind), t.Name))
+		}
+	}
+	return buf.String()
+}
+
+// Words 返回用于补全的类型名、字段名、参数名和枚举值
+func (s *GraphqlSchema) Words() []string {
+	set := make(map[string]bool)
+	for _, t := range s.Types {
+		if strings.HasPrefix(t.Name, "__") {
+			continue
+		}
+		set[t.Name] = true
+		for _, f := range t.Fields {
+			set[f.Name] = true
+			for _, a := range f.Args {
+				set[a.Name] = true
+			}
+		}
+		for _, f := range t.InputFields {
+			set[f.Name] = true
+		}
+		for _, v := range t.EnumValues {
+			set[v.Name] = true
+		}
+	}
+	words := make([]string, 0, len(set))
+	for w := range set {
+		words = append(words, w)
+	}
+	sort.Strings(words)
+	return words
+}
+
+func graphqlSchemaFile(url string) string {
+	name := graphqlSchemaNameRegexp.ReplaceAllString(strings.SplitN(url, "?", 2)[0], "_")
+	return GetRealPath(filepath.Join(GetBasePath(), GRAPHQL_DIR, strings.Trim(name, "_")+".json"))
+}
+
+// IntrospectGraphqlSchema 获取 schema 并缓存到内存和 ~/.icurl/graphql/ 下
+func IntrospectGraphqlSchema(req *HttpContext) (*GraphqlSchema, error) {
+	httpCtx, err := NewGraphqlHttpContext(req, &GraphqlRequest{Query: GRAPHQL_INTROSPECTION_QUERY, OperationName: "IntrospectionQuery"})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpCtx.Do()
+	if err != nil {
+		return nil, err
+	}
+	gqlResp, err := ParseGraphqlResponse(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(gqlResp.Errors) > 0 {
+		return nil, fmt.Errorf("introspection error: %s", gqlResp.Errors[0])
+	}
+
+	var data struct {
+		Schema *GraphqlSchema `json:"__schema"`
+	}
+	if err := json.Unmarshal(gqlResp.Data, &data); err != nil || data.Schema == nil {
+		return nil, fmt.Errorf("invalid introspection response: %v", err)
+	}
+
+	fpath := graphqlSchemaFile(req.Url)
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return nil, err
+	}
+	if bytes, err := json.Marshal(data.Schema); err == nil {
+		if err := ioutil.WriteFile(fpath, bytes, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	graphqlSchemasMu.Lock()
+	graphqlSchemas[req.Url] = data.Schema
+	graphqlSchemasMu.Unlock()
+	return data.Schema, nil
+}
+
+// LoadGraphqlSchema 从缓存中加载 schema，不存在时返回 nil
+func LoadGraphqlSchema(url string) *GraphqlSchema {
+	graphqlSchemasMu.Lock()
+	defer graphqlSchemasMu.Unlock()
+
+	if s, ok := graphqlSchemas[url]; ok {
+		return s
+	}
+	content, err := ioutil.ReadFile(graphqlSchemaFile(url))
+	if err != nil {
+		return nil
+	}
+	s := &GraphqlSchema{}
+	if err := json.Unmarshal(content, s); err != nil {
+		return nil
+	}
+	graphqlSchemas[url] = s
+	return s
+}
+
+// GraphqlCompleter 用已加载的 schema 补全行尾的单词
+func GraphqlCompleter(line string) []string {
+	graphqlSchemasMu.Lock()
+	schemas := make([]*GraphqlSchema, 0, len(graphqlSchemas))
+	for _, s := range graphqlSchemas {
+		schemas = append(schemas, s)
+	}
+	graphqlSchemasMu.Unlock()
+	if len(schemas) == 0 {
+		return nil
+	}
+
+	start := len(line)
+	for start > 0 && isIdentChar(line[start-1]) {
+		start--
+	}
+	prefix := line[start:]
+	if prefix == "" {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	candidates := make([]string, 0)
+	for _, s := range schemas {
+		for _, w := range s.Words() {
+			if strings.HasPrefix(w, prefix) && w != prefix && !seen[w] {
+				seen[w] = true
+				candidates = append(candidates, line[:start]+w)
+			}
+		}
+	}
+	return candidates
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// RunGraphqlSubscription 通过 graphql-ws 订阅，收到的每个结果写入 out，直到 c 被取消或服务端结束
+func RunGraphqlSubscription(c context.Context, req *HttpContext, gql *GraphqlRequest, out chan<- *GraphqlResponse) error {
+	conn, err := DialWs(WsUrl(req.buildUrl()), req.Header.Clone(), []string{GRAPHQL_WS_PROTOCOL, GRAPHQL_WS_LEGACY_PROTOCOL}, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(websocket.CloseNormalClosure, "")
+
+	legacy := conn.Subprotocol() == GRAPHQL_WS_LEGACY_PROTOCOL
+	Diagf("=== Subscribed to %s, subprotocol: %s\n", conn.Url, conn.Subprotocol())
+
+	send := func(v map[string]interface{}) error {
+		bytes, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return conn.SendText(string(bytes))
+	}
+
+	if err := send(map[string]interface{}{"type": "connection_init", "payload": map[string]interface{}{}}); err != nil {
+		return err
+	}
+	// 等待 connection_ack 后再订阅
+	for acked := false; !acked; {
+		msg, ok := conn.Recv(WS_WRITE_TIMEOUT)
+		if !ok || msg == nil {
+			return fmt.Errorf("connection_ack timeout")
+		}
+		if msg.Type == "close" {
+			return fmt.Errorf("connection closed %d %s", msg.Code, msg.Data)
+		}
+		if msg.Type == "text" {
+			var ack struct {
+				Type string `json:"type"`
+			}
+			acked = json.Unmarshal([]byte(msg.Data), &ack) == nil && ack.Type == "connection_ack"
+		}
+	}
+	startType, stopType := "subscribe", "complete"
+	if legacy {
+		startType, stopType = "start", "stop"
+	}
+	const id = "1"
+	if err := send(map[string]interface{}{"id": id, "type": startType, "payload": gql}); err != nil {
+		return err
+	}
+
+	for {
+		var (
+			msg *WsMessage
+			ok  bool
+		)
+		select {
+		case msg, ok = <-conn.queue:
+		case <-c.Done():
+			send(map[string]interface{}{"id": id, "type": stopType})
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		if msg.Type == "close" {
+			if msg.Code != websocket.CloseNormalClosure {
+				return fmt.Errorf("connection closed %d %s", msg.Code, msg.Data)
+			}
+			return nil
+		}
+		if msg.Type != "text" {
+			continue
+		}
+
+		var m struct {
+			Id      string          `json:"id"`
+			Type    string          `json:"type"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		if err := json.Unmarshal([]byte(msg.Data), &m); err != nil {
+			return fmt.Errorf("invalid graphql-ws message: %v", err)
+		}
+
+		switch m.Type {
+		case "next", "data":
+			resp, err := ParseGraphqlResponse(string(m.Payload))
+			if err != nil {
+				return err
+			}
+			select {
+			case out <- resp:
+			case <-c.Done():
+				send(map[string]interface{}{"id": id, "type": stopType})
+				return nil
+			}
+		case "error", "connection_error":
+			return fmt.Errorf("subscription error: %s", m.Payload)
+		case "complete":
+			return nil
+		case "ping":
+			send(map[string]interface{}{"type": "pong"})
+		}
+	}
+}
+
+// GraphqlVariablesFromJson 解析 json 字符串形式的 variables
+func GraphqlVariablesFromJson(s string) (map[string]interface{}, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	v := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil, fmt.Errorf("invalid variables: %v", err)
+	}
+	return v, nil
+}
@@ -0,0 +1,351 @@
+package lualib
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/jhump/protoreflect/dynamic/grpcdynamic"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"github.com/yuin/gopher-lua"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	GRPC_DEFAULT_TIMEOUT = 10 * time.Second
+)
+
+// GrpcRequest method 形如 "pkg.Service/Method"，Protos 为空时通过 server reflection 获取 schema
+type GrpcRequest struct {
+	Target      string
+	Method      string
+	Message     string // json
+	Metadata    map[string]string
+	Protos      []string
+	ImportPaths []string
+	TLS         bool
+	Insecure    bool // 不校验服务端证书
+	Timeout     time.Duration
+}
+
+type GrpcResponse struct {
+	Code     string
+	Message  string
+	Header   metadata.MD
+	Trailer  metadata.MD
+	Bodies   []string // json，server streaming 时有多个
+	Duration time.Duration
+}
+
+func (resp *GrpcResponse) Body() string {
+	if len(resp.Bodies) == 1 {
+		return resp.Bodies[0]
+	}
+	return "[" + strings.Join(resp.Bodies, ",") + "]"
+}
+
+func (resp *GrpcResponse) ToLTable(vm *lua.LState) *lua.LTable {
+	table := vm.NewTable()
+	SetLTableString(table, "code", resp.Code)
+	SetLTableString(table, "message", resp.Message)
+	SetLTable(table, "header", MetadataToLTable(vm, resp.Header))
+	SetLTable(table, "trailer", MetadataToLTable(vm, resp.Trailer))
+	SetLTableString(table, "body", resp.Body())
+	if v, ok := ParseJson(resp.Body()); ok {
+		SetLTable(table, "json", JsonToLValue(vm, v))
+	}
+	SetLTable(table, "duration", lua.LNumber(resp.Duration.Seconds()*1000))
+	return table
+}
+
+func MetadataToLTable(vm *lua.LState, md metadata.MD) *lua.LTable {
+	m := make(map[string]string, len(md))
+	for k, v := range md {
+		m[k] = strings.Join(v, ", ")
+	}
+	return MapStringToLTable(vm, m)
+}
+
+// Send 发送请求，按输出模式打印状态和 metadata，与 HttpContext.Send 一致
+func (req *GrpcRequest) Send() (*GrpcResponse, error) {
+	Diagf("=== Send grpc request to %s/%s\n", req.Target, req.Method)
+	resp, err := req.Do()
+	if err != nil {
+		return nil, err
+	}
+
+	Diagf("=== Status: %s, %s\n", resp.Code, resp.Duration.Round(time.Microsecond))
+	if resp.Message != "" {
+		Diagf("=== Message: %s\n", resp.Message)
+	}
+	printGrpcMetadata("Header", resp.Header)
+	if len(resp.Trailer) > 0 {
+		printGrpcMetadata("Trailer", resp.Trailer)
+	}
+	return resp, nil
+}
+
+// printGrpcMetadata 与 printResponseHead 相同，include|head 模式输出到 stdout，其他模式输出到 stderr
+func printGrpcMetadata(title string, md metadata.MD) {
+	switch outputMode {
+	case OUTPUT_SILENT:
+	case OUTPUT_INCLUDE, OUTPUT_HEAD:
+		printHeader("", http.Header(md), false)
+	case OUTPUT_VERBOSE:
+		printHeader("< ", http.Header(md), true)
+	default:
+		Diagf("=== %s:\n", title)
+		printHeader("", http.Header(md), true)
+	}
+}
+
+// Do 发送请求，grpc 状态码不为 OK 时不返回错误，由调用方根据 Code 判断
+func (req *GrpcRequest) Do() (*GrpcResponse, error) {
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = GRPC_DEFAULT_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := req.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	method, err := req.resolveMethod(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	if method.IsClientStreaming() {
+		return nil, fmt.Errorf("client streaming method %s is not supported", req.Method)
+	}
+
+	msg := dynamic.NewMessage(method.GetInputType())
+	if strings.TrimSpace(req.Message) != "" {
+		if err := msg.UnmarshalJSON([]byte(req.Message)); err != nil {
+			return nil, fmt.Errorf("encode message %s: %v", method.GetInputType().GetFullyQualifiedName(), err)
+		}
+	}
+
+	md := metadata.New(req.Metadata)
+	ctx = metadata.NewOutgoingContext(ctx, md)
+	stub := grpcdynamic.NewStub(conn)
+	resp := &GrpcResponse{Bodies: make([]string, 0)}
+	start := time.Now()
+
+	if method.IsServerStreaming() {
+		err = req.invokeServerStream(ctx, stub, method, msg, resp)
+	} else {
+		var out proto.Message
+		out, err = stub.InvokeRpc(ctx, method, msg, grpc.Header(&resp.Header), grpc.Trailer(&resp.Trailer))
+		if err == nil {
+			err = resp.appendBody(out)
+		}
+	}
+	resp.Duration = time.Since(start)
+
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil, err
+	}
+	resp.Code, resp.Message = st.Code().String(), st.Message()
+	return resp, nil
+}
+
+func (req *GrpcRequest) invokeServerStream(ctx context.Context, stub grpcdynamic.Stub, method *desc.MethodDescriptor, msg proto.Message, resp *GrpcResponse) error {
+	stream, err := stub.InvokeRpcServerStream(ctx, method, msg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		resp.Header, _ = stream.Header()
+		resp.Trailer = stream.Trailer()
+	}()
+
+	for {
+		out, err := stream.RecvMsg()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := resp.appendBody(out); err != nil {
+			return err
+		}
+	}
+}
+
+func (resp *GrpcResponse) appendBody(out proto.Message) error {
+	dm, err := dynamic.AsDynamicMessage(out)
+	if err != nil {
+		return err
+	}
+	bytes, err := dm.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	resp.Bodies = append(resp.Bodies, string(bytes))
+	return nil
+}
+
+func (req *GrpcRequest) dial(ctx context.Context) (*grpc.ClientConn, error) {
+	opts := []grpc.DialOption{grpc.WithBlock()}
+	if req.TLS {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: req.Insecure})))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	conn, err := grpc.DialContext(ctx, req.Target, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %v", req.Target, err)
+	}
+	return conn, nil
+}
+
+func (req *GrpcRequest) resolveMethod(ctx context.Context, conn *grpc.ClientConn) (*desc.MethodDescriptor, error) {
+	idx := strings.LastIndex(req.Method, "/")
+	if idx <= 0 {
+		return nil, fmt.Errorf("invalid method %s, need \"pkg.Service/Method\"", req.Method)
+	}
+	svcName, methodName := strings.TrimPrefix(req.Method[:idx], "/"), req.Method[idx+1:]
+
+	var svc *desc.ServiceDescriptor
+	if len(req.Protos) > 0 {
+		parser := protoparse.Parser{ImportPaths: req.ImportPaths}
+		protos := req.Protos
+		if len(req.ImportPaths) == 0 {
+			// 未指定 import 路径时，以 proto 文件所在目录作为 import 路径
+			protos = make([]string, 0, len(req.Protos))
+			for _, p := range req.Protos {
+				parser.ImportPaths = append(parser.ImportPaths, filepath.Dir(p))
+				protos = append(protos, filepath.Base(p))
+			}
+		}
+		files, err := parser.ParseFiles(protos...)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if svc = f.FindService(svcName); svc != nil {
+				break
+			}
+		}
+		if svc == nil {
+			return nil, fmt.Errorf("service %s not found in %s", svcName, strings.Join(req.Protos, ", "))
+		}
+	} else {
+		client := grpcreflect.NewClient(ctx, rpb.NewServerReflectionClient(conn))
+		defer client.Reset()
+
+		var err error
+		if svc, err = client.ResolveService(svcName); err != nil {
+			return nil, fmt.Errorf("resolve service %s via reflection: %v", svcName, err)
+		}
+	}
+
+	method := svc.FindMethodByName(methodName)
+	if method == nil {
+		return nil, fmt.Errorf("method %s not found in service %s", methodName, svcName)
+	}
+	return method, nil
+}
+
+// GrpcTarget 将 context.url 转换为 host:port，https 时使用 tls
+func GrpcTarget(rawurl string) (string, bool) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return rawurl, false
+	}
+	useTLS := u.Scheme == "https" || u.Scheme == "grpcs"
+	if u.Port() == "" {
+		if useTLS {
+			return u.Host + ":443", true
+		}
+		return u.Host + ":80", false
+	}
+	return u.Host, useTLS
+}
+
+// LTableToGrpcRequest 解析 {target, method, message={}, metadata={}, proto={}, import_paths={}, tls=false, insecure=false, timeout="10s"}
+// 省略 target 时使用 context.url
+func LTableToGrpcRequest(table *lua.LTable, ctx *lua.LTable, vars map[string]string) (*GrpcRequest, error) {
+	req := &GrpcRequest{
+		Target:   ExpandVars(GetLTableString(table, "target"), vars),
+		Method:   GetLTableString(table, "method"),
+		Metadata: ExpandMapVars(LTableToMapString(GetLTableTable(table, "metadata")), vars),
+	}
+	if req.Method == "" {
+		return nil, fmt.Errorf("method is required, e.g. \"pkg.Service/Method\"")
+	}
+
+	if req.Target == "" {
+		if ctx == nil {
+			return nil, fmt.Errorf("target is required")
+		}
+		req.Target, req.TLS = GrpcTarget(ExpandVars(GetLTableString(ctx, "url"), vars))
+	} else {
+		for _, scheme := range []string{"grpc://", "grpcs://", "http://", "https://"} {
+			if strings.HasPrefix(req.Target, scheme) {
+				req.Target, req.TLS = GrpcTarget(req.Target)
+				break
+			}
+		}
+	}
+	if b, ok := table.RawGetString("tls").(lua.LBool); ok {
+		req.TLS = bool(b)
+	}
+	req.Insecure = table.RawGetString("insecure") == lua.LTrue
+
+	switch v := table.RawGetString("message").(type) {
+	case *lua.LTable:
+		s, err := LTableToJsonString(v, false)
+		if err != nil {
+			return nil, err
+		}
+		req.Message = ExpandVars(s, vars)
+	case lua.LString:
+		req.Message = ExpandVars(string(v), vars)
+	}
+
+	switch v := table.RawGetString("proto").(type) {
+	case *lua.LTable:
+		req.Protos = LTableToStringSlice(v)
+	case lua.LString:
+		req.Protos = []string{string(v)}
+	}
+	for i, p := range req.Protos {
+		req.Protos[i] = GetRealPath(p)
+	}
+	if t := GetLTableTable(table, "import_paths"); t != nil {
+		req.ImportPaths = LTableToStringSlice(t)
+		for i, p := range req.ImportPaths {
+			req.ImportPaths[i] = GetRealPath(p)
+		}
+	}
+
+	if s := GetLTableString(table, "timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+		req.Timeout = d
+	}
+	return req, nil
+}
@@ -0,0 +1,104 @@
+package lualib
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+const healthProto = `syntax = "proto3";
+
+package grpc.health.v1;
+
+message HealthCheckRequest {
+  string service = 1;
+}
+
+message HealthCheckResponse {
+  enum ServingStatus {
+    UNKNOWN = 0;
+    SERVING = 1;
+    NOT_SERVING = 2;
+    SERVICE_UNKNOWN = 3;
+  }
+  ServingStatus status = 1;
+}
+
+service Health {
+  rpc Check(HealthCheckRequest) returns (HealthCheckResponse);
+  rpc Watch(HealthCheckRequest) returns (stream HealthCheckResponse);
+}
+`
+
+// startGrpcServer 启动带 reflection 的 health 服务，返回监听地址
+func startGrpcServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	hs.SetServingStatus("orders", healthpb.HealthCheckResponse_SERVING)
+
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, hs)
+	reflection.Register(s)
+	go s.Serve(ln)
+	t.Cleanup(s.Stop)
+	return ln.Addr().String()
+}
+
+func TestGrpcReflection(t *testing.T) {
+	req := &GrpcRequest{
+		Target:  startGrpcServer(t),
+		Method:  "grpc.health.v1.Health/Check",
+		Message: `{"service": "orders"}`,
+	}
+	resp, err := req.Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != "OK" || resp.Body() != `{"status":"SERVING"}` {
+		t.Fatalf("unexpected response %s %s", resp.Code, resp.Body())
+	}
+
+	req.Message = `{"service": "unknown"}`
+	if resp, err = req.Do(); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != "NotFound" {
+		t.Fatalf("unexpected code %s", resp.Code)
+	}
+}
+
+func TestGrpcProtoFile(t *testing.T) {
+	dir := t.TempDir()
+	proto := filepath.Join(dir, "health.proto")
+	if err := ioutil.WriteFile(proto, []byte(healthProto), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &GrpcRequest{
+		Target:  startGrpcServer(t),
+		Method:  "grpc.health.v1.Health/Check",
+		Message: `{"service": "orders"}`,
+		Protos:  []string{proto},
+	}
+	resp, err := req.Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != "OK" || resp.Body() != `{"status":"SERVING"}` {
+		t.Fatalf("unexpected response %s %s", resp.Code, resp.Body())
+	}
+
+	req.Method = "grpc.health.v1.Health/Missing"
+	if _, err := req.Do(); err == nil {
+		t.Fatal("expected error for missing method")
+	}
+}
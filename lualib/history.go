@@ -0,0 +1,228 @@
+package lualib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	HISTORY_MAX_SIZE = 100
+	HISTORY_FILE     = "history.jsonl"
+)
+
+var (
+	DefaultHistory = NewHistory(HISTORY_MAX_SIZE)
+)
+
+type HistoryEntry struct {
+	Id       int
+	Request  *HttpContext
+	Response *HttpResponse
+	// Truncated 代理记录的 body 超过 PROXY_MAX_BODY 被截断，请求不能按原样重放
+	Truncated bool `json:",omitempty"`
+}
+
+// History 保存本次会话的请求和响应，开启持久化后追加写入 ~/.icurl/history.jsonl
+type History struct {
+	mu      sync.Mutex
+	entries []*HistoryEntry
+	maxSize int
+	nextId  int
+	fpath   string
+}
+
+func NewHistory(maxSize int) *History {
+	return &History{
+		entries: make([]*HistoryEntry, 0),
+		maxSize: maxSize,
+		nextId:  1,
+	}
+}
+
+func (h *History) Add(req *HttpContext, resp *HttpResponse) *HistoryEntry {
+	return h.AddEntry(&HistoryEntry{Request: req, Response: resp})
+}
+
+// AddEntry 分配编号并添加记录
+func (h *History) AddEntry(entry *HistoryEntry) *HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entry.Id = h.nextId
+	h.nextId++
+	h.append(entry)
+
+	if h.fpath != "" {
+		if err := h.write(entry); err != nil {
+			fmt.Fprintf(os.Stderr, "write history error: %v\n", err)
+		}
+	}
+	return entry
+}
+
+func (h *History) append(entry *HistoryEntry) {
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > h.maxSize {
+		h.entries = h.entries[len(h.entries)-h.maxSize:]
+	}
+}
+
+func (h *History) Get(id int) (*HistoryEntry, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, entry := range h.entries {
+		if entry.Id == id {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+func (h *History) Last() (*HistoryEntry, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.entries) == 0 {
+		return nil, false
+	}
+	return h.entries[len(h.entries)-1], true
+}
+
+// Entries 返回最近的 n 条记录，n <= 0 返回全部
+func (h *History) Entries(n int) []*HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if n <= 0 || n > len(h.entries) {
+		n = len(h.entries)
+	}
+	res := make([]*HistoryEntry, n)
+	copy(res, h.entries[len(h.entries)-n:])
+	return res
+}
+
+// Persist 开启持久化，并加载已有的历史记录
+func (h *History) Persist(fpath string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.fpath = fpath
+	if !FileExists(fpath) {
+		return nil
+	}
+
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	loaded := make([]*HistoryEntry, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		entry := &HistoryEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			continue
+		}
+		loaded = append(loaded, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// 已加载的记录排在本次会话之前，按列表顺序重新编号，保证编号与 history() 的顺序一致
+	h.entries = append(loaded, h.entries...)
+	if len(h.entries) > h.maxSize {
+		h.entries = h.entries[len(h.entries)-h.maxSize:]
+	}
+	for i, entry := range h.entries {
+		entry.Id = i + 1
+	}
+	h.nextId = len(h.entries) + 1
+	return nil
+}
+
+func (h *History) Unpersist() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.fpath = ""
+}
+
+func (h *History) write(entry *HistoryEntry) error {
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(h.fpath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(bytes, '\n'))
+	return err
+}
+
+func (entry *HistoryEntry) String() string {
+	truncated := ""
+	if entry.Truncated {
+		truncated = " (truncated)"
+	}
+	return fmt.Sprintf("%4d  %s  %-6s %s  %d  %s  %dB%s",
+		entry.Id,
+		entry.Response.Time.Format("15:04:05"),
+		strings.ToUpper(entry.Request.Method),
+		entry.Request.buildUrl(),
+		entry.Response.StatusCode,
+		entry.Response.Duration.Round(time.Millisecond),
+		len(entry.Response.Body),
+		truncated,
+	)
+}
+
+func CheckGetHistoryEntry(vm *lua.LState, n int) (*HistoryEntry, bool) {
+	id := vm.CheckInt(n)
+	entry, ok := DefaultHistory.Get(id)
+	if !ok {
+		vm.RaiseError("history entry %d not exists", id)
+		return nil, false
+	}
+	return entry, true
+}
+
+// ToLTable 转换为 lua table，body 是 json 时同时提供解析后的 json 字段，多个值的 header 转换为数组
+func (entry *HistoryEntry) ToLTable(vm *lua.LState) *lua.LTable {
+	resp := entry.Response
+
+	request := vm.NewTable()
+	SetLTableString(request, "method", strings.ToUpper(entry.Request.Method))
+	SetLTableString(request, "url", entry.Request.buildUrl())
+	SetLTableString(request, "data", entry.Request.Data)
+	SetLTable(request, "header", ParamsToLTable(vm, entry.Request.Header))
+
+	table := vm.NewTable()
+	SetLTable(table, "id", lua.LNumber(entry.Id))
+	SetLTable(table, "status", lua.LNumber(resp.StatusCode))
+	SetLTable(table, "header", ParamsToLTable(vm, HeaderToParams(resp.Header)))
+	SetLTableString(table, "body", resp.Body)
+	SetLTable(table, "duration", lua.LNumber(resp.Duration.Milliseconds()))
+	SetLTable(table, "request", request)
+	if entry.Truncated {
+		SetLTable(table, "truncated", lua.LTrue)
+	}
+	if v, ok := ParseJson(resp.Body); ok {
+		SetLTable(table, "json", JsonToLValue(vm, v))
+	}
+	return table
+}
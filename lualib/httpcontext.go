@@ -1,21 +1,59 @@
 package lualib
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/parnurzeal/gorequest"
+	"golang.org/x/net/http2"
+)
+
+const (
+	HTTP_VERSION_AUTO = "auto" // https 时通过 ALPN 协商，http 时使用 HTTP/1.1
+	HTTP_VERSION_1_1  = "1.1"
+	HTTP_VERSION_2    = "2"   // https 时必须协商为 HTTP/2，http 时使用 h2c
+	HTTP_VERSION_H2C  = "h2c" // http 时使用 h2c（prior knowledge），https 时同 auto
 )
 
 type HttpContext struct {
 	Url    string
 	Method string
 	Data   string // if data is not empty, use data
-	Query  map[string]string
-	Header map[string]string
+	Query  Params
+	Header Params
+	Form   Params `json:",omitempty"` // urlencoded body，data 为空时使用
+	Json   string `json:",omitempty"` // json body，由 context.json 编码，data 为空时使用
+
+	UnixSocket  string            `json:",omitempty"` // 通过 unix socket 发送请求
+	Resolve     map[string]string `json:",omitempty"` // host:port => addr:port，类似 curl --resolve
+	HttpVersion string            `json:",omitempty"` // auto|1.1|2|h2c
+	Compressed  bool              `json:",omitempty"` // 发送 Accept-Encoding，并解压响应
+	GzipRequest bool              `json:",omitempty"` // 使用 gzip 压缩请求 body
+	Retry       *RetryPolicy      `json:",omitempty"` // 重试策略，只在 Send 中生效
+
+	Transport *http.Transport `json:"-"` // shared transport, nil means a new transport per request
+}
+
+type HttpResponse struct {
+	StatusCode  int
+	Header      http.Header
+	Body        string
+	Time        time.Time
+	Duration    time.Duration
+	Proto       string `json:",omitempty"` // 协商的协议，如 HTTP/2.0
+	Encoding    string `json:",omitempty"` // 响应的 Content-Encoding
+	EncodedSize int    `json:",omitempty"` // 解压前的大小，0 表示没有解压
+	Replayed    bool   `json:"-"`          // replayed from cassette
+
+	Request *http.Request `json:"-"` // 实际发送的请求，回放时为 nil
 }
 
 func NewHttpContext() *HttpContext {
@@ -26,12 +64,8 @@ func (ctx *HttpContext) buildUrl() string {
 	if ctx.Url == "" {
 		return ""
 	}
-	if strings.ToUpper(ctx.Method) == "GET" && len(ctx.Query) > 0 {
-		val := url.Values{}
-		for k, v := range ctx.Query {
-			val.Add(k, v)
-		}
-		url := val.Encode()
+	if len(ctx.Query) > 0 {
+		url := ctx.Query.Encode()
 		if strings.Contains(ctx.Url, "?") {
 			return ctx.Url + "&" + url
 		} else {
@@ -41,13 +75,67 @@ func (ctx *HttpContext) buildUrl() string {
 	return ctx.Url
 }
 
-func (ctx *HttpContext) Send() (string, error) {
+// Send 发送请求，按输出模式将请求地址、状态等诊断信息输出到 stderr
+func (ctx *HttpContext) Send() (*HttpResponse, error) {
+	Diagf("=== Send request to (%s)%s\n", strings.ToUpper(ctx.Method), ctx.buildUrl())
+	if ctx.UnixSocket != "" {
+		Diagf("=== Unix socket: %s\n", ctx.UnixSocket)
+	}
+	for k, v := range ctx.Resolve {
+		Diagf("=== Resolve: %s => %s\n", k, v)
+	}
+	resp, err := ctx.sendWithRetry(ctx.Do)
+	if err != nil {
+		return nil, err
+	}
+
+	if outputMode == OUTPUT_VERBOSE {
+		printRequest(ctx, resp.Request)
+	}
+	if resp.Replayed {
+		Diagf("=== Replayed from cassette\n")
+	}
+	Diagf("=== Status code: %d\n", resp.StatusCode)
+	if resp.Proto != "" {
+		Diagf("=== Protocol: %s\n", resp.Proto)
+	}
+	if resp.Encoding != "" {
+		if resp.EncodedSize > 0 {
+			Diagf("=== Content-Encoding: %s, %d bytes => %d bytes\n", resp.Encoding, resp.EncodedSize, len(resp.Body))
+		} else {
+			Diagf("=== Content-Encoding: %s, not decoded\n", resp.Encoding)
+		}
+	}
+	printResponseHead(resp)
+	return resp, nil
+}
+
+// Do 发送请求，不打印任何信息，可以并发调用
+// 开启 cassette 时由 cassette 决定回放还是发送
+func (ctx *HttpContext) Do() (*HttpResponse, error) {
+	if c := GetCassette(); c != nil {
+		return c.Do(ctx)
+	}
+	return ctx.do()
+}
+
+func (ctx *HttpContext) do() (*HttpResponse, error) {
 	url := ctx.buildUrl()
 	if url == "" {
-		return "", errors.New("http context info invalid")
+		return nil, errors.New("http context info invalid")
+	}
+	if err := ctx.checkHttpVersion(); err != nil {
+		return nil, err
 	}
 
 	request := gorequest.New().Timeout(3 * time.Second)
+	if ctx.Transport != nil {
+		request.Transport = ctx.Transport
+	} else if t := ctx.NewTransport(); t != nil {
+		request.Transport = t
+	}
+	// gorequest 按 key 排序重新编码 query，发送时恢复原始顺序
+	request.Client.Transport = newOrderedQueryTransport(request.Transport, url)
 
 	method := strings.ToUpper(ctx.Method)
 	switch method {
@@ -60,35 +148,263 @@ func (ctx *HttpContext) Send() (string, error) {
 	case "DELETE":
 		request.Delete(url)
 	default:
-		return "", errors.New("only supported GET|POST|PUT|DELETE method")
+		return nil, errors.New("only supported GET|POST|PUT|DELETE method")
 	}
 
 	if method != "GET" {
-		if ctx.Data != "" {
-			request.Send(ctx.Data)
-		} else {
-			request.SendMap(ctx.Query)
+		body, contentType := ctx.Body()
+		if body != "" && ctx.GzipRequest {
+			if err := sendGzip(request, body, contentType); err != nil {
+				return nil, err
+			}
+		} else if contentType != "" {
+			request.BounceToRawString = true
+			request.Send(body)
+			request.Set("Content-Type", contentType)
+		} else if body != "" {
+			request.Send(body)
 		}
 	}
 
-	if len(ctx.Header) > 0 {
-		for hk, hv := range ctx.Header {
-			request.Set(hk, hv)
-		}
+	if ctx.Compressed {
+		request.Set("Accept-Encoding", ACCEPT_ENCODING)
 	}
+	ctx.Header.ApplyHeader(request.Header)
 
-	fmt.Printf("=== Send request to (%s)%s\n", method, url)
+	start := time.Now()
 	resp, bodyStr, errs := request.End()
 	if len(errs) > 0 {
-		return "", errs[0]
+		return nil, errs[0]
+	}
+
+	res := &HttpResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       bodyStr,
+		Time:       start,
+		Duration:   time.Since(start),
+		Proto:      resp.Proto,
+		Request:    resp.Request,
+	}
+	// 设置了 Accept-Encoding 时标准库不会自动解压
+	if res.Encoding = resp.Header.Get("Content-Encoding"); res.Encoding != "" {
+		if decoded, err := DecodeContentEncoding(res.Encoding, []byte(bodyStr)); err == nil {
+			res.EncodedSize, res.Body = len(bodyStr), string(decoded)
+		}
+	}
+	return res, nil
+}
+
+func init() {
+	// 由 do 设置 Client.Transport，见 orderedQueryTransport
+	gorequest.DisableTransportSwap = true
+}
+
+// orderedQueryTransport 将 query 恢复为原始顺序，只处理参数相同的请求，重定向后的请求不受影响
+type orderedQueryTransport struct {
+	http.RoundTripper
+	rawQuery string
+	values   string // 排序后的编码，用于判断参数是否相同
+}
+
+func newOrderedQueryTransport(rt http.RoundTripper, rawurl string) http.RoundTripper {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.RawQuery == "" {
+		return rt
 	}
+	return &orderedQueryTransport{RoundTripper: rt, rawQuery: u.RawQuery, values: u.Query().Encode()}
+}
+
+func (t *orderedQueryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.RawQuery != t.rawQuery && req.URL.Query().Encode() == t.values {
+		req = req.Clone(req.Context())
+		req.URL.RawQuery = t.rawQuery
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// Body 返回请求 body，优先级为 data、json、form，contentType 为空表示由 body 内容推断
+func (ctx *HttpContext) Body() (body string, contentType string) {
+	switch {
+	case ctx.Data != "":
+		return ctx.Data, ""
+	case ctx.Json != "":
+		return ctx.Json, "application/json"
+	case len(ctx.Form) > 0:
+		return ctx.Form.Encode(), "application/x-www-form-urlencoded"
+	}
+	return "", ""
+}
 
-	fmt.Printf("=== Status code: %d\n", resp.StatusCode)
-	fmt.Printf("=== Response header\n")
-	for k, v := range resp.Header {
-		fmt.Printf("%s = %s\n", k, v[0])
+// sendGzip 压缩 body 后原样发送，没有指定 Content-Type 时按 body 内容推断
+func sendGzip(request *gorequest.SuperAgent, data, contentType string) error {
+	body, err := GzipString(data)
+	if err != nil {
+		return err
 	}
-	fmt.Println()
 
-	return bodyStr, nil
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+		if _, ok := ParseJson(data); ok {
+			contentType = "application/json"
+		} else if _, err := url.ParseQuery(data); err == nil && strings.Contains(data, "=") {
+			contentType = "application/x-www-form-urlencoded"
+		}
+	}
+
+	request.BounceToRawString = true
+	request.Send(body)
+	request.Set("Content-Type", contentType)
+	request.Set("Content-Encoding", "gzip")
+	return nil
+}
+
+// SplitUnixUrl 解析 http+unix://%2Fvar%2Frun%2Fdocker.sock/path 形式的地址，返回 socket 路径和 http 地址
+func SplitUnixUrl(rawurl string) (string, string, bool) {
+	const scheme = "http+unix://"
+	if !strings.HasPrefix(rawurl, scheme) {
+		return "", rawurl, false
+	}
+	rest := rawurl[len(scheme):]
+	host, path := rest, "/"
+	if idx := strings.IndexAny(rest, "/?"); idx >= 0 {
+		host, path = rest[:idx], rest[idx:]
+	}
+	socket, err := url.PathUnescape(host)
+	if err != nil {
+		return "", rawurl, false
+	}
+	if strings.HasPrefix(path, "?") {
+		path = "/" + path
+	}
+	return socket, "http://localhost" + path, true
+}
+
+// ParseResolve 解析 curl 风格的 host:port:addr，返回 host:port => addr:port
+func ParseResolve(entries []string) (map[string]string, error) {
+	res := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid resolve %s, need host:port:addr", entry)
+		}
+		host, port, addr := parts[0], parts[1], strings.Trim(parts[2], "[]")
+		res[net.JoinHostPort(host, port)] = net.JoinHostPort(addr, port)
+	}
+	return res, nil
+}
+
+// NewTransport 设置了 unix socket 或 resolve 时返回使用自定义 dialer 的 transport，否则返回 nil
+func (ctx *HttpContext) NewTransport() *http.Transport {
+	if ctx.UnixSocket == "" && len(ctx.Resolve) == 0 && (ctx.HttpVersion == "" || ctx.HttpVersion == HTTP_VERSION_AUTO) {
+		return nil
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           ctx.DialContext(&net.Dialer{Timeout: 3 * time.Second, KeepAlive: 30 * time.Second}),
+		TLSHandshakeTimeout:   3 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	ctx.ApplyHttpVersion(t)
+	return t
+}
+
+func (ctx *HttpContext) checkHttpVersion() error {
+	switch ctx.HttpVersion {
+	case "", HTTP_VERSION_AUTO, HTTP_VERSION_1_1, HTTP_VERSION_2, HTTP_VERSION_H2C:
+		return nil
+	default:
+		return fmt.Errorf("invalid http_version %s, need auto|1.1|2|h2c", ctx.HttpVersion)
+	}
+}
+
+// ApplyHttpVersion 按 http_version 设置 transport，HTTP/2 和 h2c 使用 x/net/http2 的 transport
+func (ctx *HttpContext) ApplyHttpVersion(t *http.Transport) {
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 3 * time.Second}).DialContext
+	}
+
+	switch ctx.HttpVersion {
+	case HTTP_VERSION_1_1:
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	case HTTP_VERSION_2, HTTP_VERSION_H2C:
+		t.RegisterProtocol("http", &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(context.Background(), network, addr)
+			},
+		})
+		if ctx.HttpVersion == HTTP_VERSION_H2C {
+			t.ForceAttemptHTTP2 = true
+			break
+		}
+		t.RegisterProtocol("https", &http2.Transport{
+			TLSClientConfig: t.TLSClientConfig,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := dial(context.Background(), network, addr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := tls.Client(conn, cfg)
+				if err := tlsConn.Handshake(); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				if p := tlsConn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+					tlsConn.Close()
+					return nil, fmt.Errorf("server does not support HTTP/2, negotiated protocol %q", p)
+				}
+				return tlsConn, nil
+			},
+		})
+	default:
+		t.ForceAttemptHTTP2 = true
+	}
+}
+
+// DialContext 连接 unix socket，或者将 host:port 替换为 resolve 中指定的地址
+func (ctx *HttpContext) DialContext(dialer *net.Dialer) func(c context.Context, network, addr string) (net.Conn, error) {
+	return func(c context.Context, network, addr string) (net.Conn, error) {
+		if ctx.UnixSocket != "" {
+			return dialer.DialContext(c, "unix", ctx.UnixSocket)
+		}
+		if to, ok := ctx.Resolve[addr]; ok {
+			addr = to
+		}
+		return dialer.DialContext(c, network, addr)
+	}
+}
+
+// NewRequest 构造标准库的请求，用于需要自行读取响应的场景，如流式响应
+func (ctx *HttpContext) NewRequest(c context.Context) (*http.Request, error) {
+	url := ctx.buildUrl()
+	if url == "" {
+		return nil, errors.New("http context info invalid")
+	}
+
+	var body io.Reader
+	data, contentType := ctx.Body()
+	if data != "" {
+		body = strings.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(c, strings.ToUpper(ctx.Method), url, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	ctx.Header.ApplyHeader(req.Header)
+	return req, nil
+}
+
+// Clone 复制请求，query 和 header 不与原请求共享
+func (ctx *HttpContext) Clone() *HttpContext {
+	clone := *ctx
+	clone.Query = ctx.Query.Clone()
+	clone.Header = ctx.Header.Clone()
+	clone.Form = ctx.Form.Clone()
+	return &clone
 }
@@ -0,0 +1,98 @@
+package lualib
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+var protoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(r.Proto))
+})
+
+// newVersionContext 构造访问 server 的请求，server 为 tls 时信任其证书
+func newVersionContext(server *httptest.Server, version string) *HttpContext {
+	ctx := NewHttpContext()
+	ctx.Method = "GET"
+	ctx.Url = server.URL
+	ctx.HttpVersion = version
+	if server.TLS != nil {
+		tr := &http.Transport{TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()}
+		ctx.ApplyHttpVersion(tr)
+		ctx.Transport = tr
+	}
+	return ctx
+}
+
+// doHttpVersion 按 http_version 发送请求，返回响应的协议
+func doHttpVersion(t *testing.T, server *httptest.Server, version string) string {
+	resp, err := newVersionContext(server, version).Do()
+	if err != nil {
+		t.Fatalf("http_version %q: %v", version, err)
+	}
+	if resp.Proto != resp.Body {
+		t.Fatalf("http_version %q: response proto %s, server proto %s", version, resp.Proto, resp.Body)
+	}
+	return resp.Proto
+}
+
+func TestHttpVersion11(t *testing.T) {
+	server := httptest.NewServer(protoHandler)
+	defer server.Close()
+
+	for _, version := range []string{"", HTTP_VERSION_AUTO, HTTP_VERSION_1_1} {
+		if proto := doHttpVersion(t, server, version); proto != "HTTP/1.1" {
+			t.Fatalf("http_version %q: got %s, want HTTP/1.1", version, proto)
+		}
+	}
+}
+
+func TestHttpVersion2(t *testing.T) {
+	server := httptest.NewUnstartedServer(protoHandler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	cases := map[string]string{
+		HTTP_VERSION_AUTO: "HTTP/2.0",
+		HTTP_VERSION_2:    "HTTP/2.0",
+		HTTP_VERSION_1_1:  "HTTP/1.1",
+	}
+	for version, want := range cases {
+		if proto := doHttpVersion(t, server, version); proto != want {
+			t.Fatalf("http_version %q: got %s, want %s", version, proto, want)
+		}
+	}
+}
+
+func TestHttpVersion2RequiresNegotiation(t *testing.T) {
+	server := httptest.NewUnstartedServer(protoHandler)
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	if _, err := newVersionContext(server, HTTP_VERSION_2).Do(); err == nil {
+		t.Fatal("expected error when server does not negotiate HTTP/2")
+	}
+}
+
+func TestHttpVersionH2c(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(protoHandler, &http2.Server{}))
+	defer server.Close()
+
+	cases := map[string]string{
+		HTTP_VERSION_H2C: "HTTP/2.0",
+		HTTP_VERSION_2:   "HTTP/2.0",
+		HTTP_VERSION_1_1: "HTTP/1.1",
+	}
+	for version, want := range cases {
+		if proto := doHttpVersion(t, server, version); proto != want {
+			t.Fatalf("http_version %q: got %s, want %s", version, proto, want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package lualib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	JSON_TYPE_FIELD  = "__jsontype"
+	JSON_TYPE_ARRAY  = "array"
+	JSON_TYPE_OBJECT = "object"
+)
+
+type jsonNullType struct{}
+
+var (
+	// JsonNull lua 中的 json.null，编码为 null
+	JsonNull = &lua.LUserData{Value: jsonNullType{}}
+)
+
+// RegisterJsonModule 注册全局 json table：json.null、json.array(t)、json.object(t)、json.number(s)
+func RegisterJsonModule(vm *lua.LState) {
+	nullMeta := vm.NewTable()
+	nullMeta.RawSetString("__tostring", vm.NewFunction(func(vm *lua.LState) int {
+		vm.Push(lua.LString("json.null"))
+		return 1
+	}))
+	JsonNull.Metatable = nullMeta
+
+	mod := vm.NewTable()
+	mod.RawSetString("null", JsonNull)
+	mod.RawSetString("array", vm.NewFunction(jsonMarker(JSON_TYPE_ARRAY)))
+	mod.RawSetString("object", vm.NewFunction(jsonMarker(JSON_TYPE_OBJECT)))
+	mod.RawSetString("number", vm.NewFunction(jsonNumber))
+	vm.SetGlobal("json", mod)
+}
+
+// jsonMarker 标记 table 编码为数组或对象，用于区分空数组和空对象，省略参数时返回新的空 table
+func jsonMarker(typ string) lua.LGFunction {
+	return func(vm *lua.LState) int {
+		t := vm.OptTable(1, vm.NewTable())
+		mt := vm.NewTable()
+		mt.RawSetString(JSON_TYPE_FIELD, lua.LString(typ))
+		vm.SetMetatable(t, mt)
+		vm.Push(t)
+		return 1
+	}
+}
+
+// jsonNumber 原样编码的数字，用于超过 2^53 无法用 lua number 精确表示的整数，如 json.number("1234567890123456789")
+func jsonNumber(vm *lua.LState) int {
+	s := vm.CheckString(1)
+	if _, err := strconv.ParseFloat(s, 64); err != nil {
+		vm.ArgError(1, "invalid json number "+s)
+		return 0
+	}
+	vm.Push(newJsonNumber(vm, json.Number(s)))
+	return 1
+}
+
+func newJsonNumber(vm *lua.LState, n json.Number) *lua.LUserData {
+	ud := vm.NewUserData()
+	ud.Value = n
+	mt := vm.NewTable()
+	mt.RawSetString("__tostring", vm.NewFunction(func(vm *lua.LState) int {
+		vm.Push(lua.LString(n))
+		return 1
+	}))
+	vm.SetMetatable(ud, mt)
+	return ud
+}
+
+func jsonType(t *lua.LTable) string {
+	if mt, ok := t.Metatable.(*lua.LTable); ok {
+		return lua.LVAsString(mt.RawGetString(JSON_TYPE_FIELD))
+	}
+	return ""
+}
+
+// jsonNumberValue 整数编码为 int64，避免 1e+18 形式的浮点数
+func jsonNumberValue(n lua.LNumber) interface{} {
+	f := float64(n)
+	if f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+		return int64(f)
+	}
+	return f
+}
+
+// LValueToJsonValue 转换为可以 json 编码的值
+// 连续整数 key 的 table 转换为数组，空 table 转换为对象，可以通过 json.array()/json.object() 指定
+func LValueToJsonValue(v lua.LValue) (interface{}, error) {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return jsonNumberValue(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LNilType:
+		return nil, nil
+	case *lua.LUserData:
+		switch uv := v.Value.(type) {
+		case jsonNullType:
+			return nil, nil
+		case json.Number:
+			return uv, nil
+		}
+	case *lua.LTable:
+		n := v.MaxN()
+		switch jsonType(v) {
+		case JSON_TYPE_ARRAY:
+			return ltableToJsonArray(v, n)
+		case JSON_TYPE_OBJECT:
+			return ltableToJsonObject(v)
+		}
+		if n == 0 || countLTableKeys(v) != n {
+			return ltableToJsonObject(v)
+		}
+		return ltableToJsonArray(v, n)
+	}
+	return nil, errors.New("table value only supported type of bool|number|string|nil|table|json.null")
+}
+
+func ltableToJsonArray(t *lua.LTable, n int) (interface{}, error) {
+	arr := make([]interface{}, 0, n)
+	for i := 1; i <= n; i++ {
+		item, err := LValueToJsonValue(t.RawGetInt(i))
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, item)
+	}
+	return arr, nil
+}
+
+// ltableToJsonObject 数字 key 转换为字符串
+func ltableToJsonObject(t *lua.LTable) (interface{}, error) {
+	m := make(map[string]interface{})
+	var err error
+	t.ForEach(func(key, value lua.LValue) {
+		if err != nil {
+			return
+		}
+		var k string
+		switch key := key.(type) {
+		case lua.LString:
+			k = string(key)
+		case lua.LNumber:
+			k = fmt.Sprint(jsonNumberValue(key))
+		default:
+			err = errors.New("table key only supported string|number type")
+			return
+		}
+		m[k], err = LValueToJsonValue(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// JsonToLValueExact 与 JsonToLValue 类似，但保留 null、空数组和无法精确表示的整数，用于恢复 context.json
+func JsonToLValueExact(vm *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return JsonNull
+	case json.Number:
+		if i, err := v.Int64(); err == nil && math.Abs(float64(i)) <= 1<<53 {
+			return lua.LNumber(i)
+		} else if err == nil {
+			return newJsonNumber(vm, v)
+		}
+		f, _ := v.Float64()
+		return lua.LNumber(f)
+	case []interface{}:
+		arr := vm.NewTable()
+		for _, item := range v {
+			arr.Append(JsonToLValueExact(vm, item))
+		}
+		if len(v) == 0 {
+			mt := vm.NewTable()
+			mt.RawSetString(JSON_TYPE_FIELD, lua.LString(JSON_TYPE_ARRAY))
+			vm.SetMetatable(arr, mt)
+		}
+		return arr
+	case map[string]interface{}:
+		table := vm.NewTable()
+		for k, item := range v {
+			table.RawSetString(k, JsonToLValueExact(vm, item))
+		}
+		return table
+	}
+	return JsonToLValue(vm, v)
+}
@@ -0,0 +1,218 @@
+package lualib
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/yuin/gopher-lua"
+)
+
+var (
+	rpcId int64
+)
+
+type RpcRequest struct {
+	Jsonrpc string      `json:"jsonrpc"`
+	Id      int64       `json:"id"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+type RpcError struct {
+	Code    int64
+	Message string
+	Data    interface{}
+}
+
+func (e *RpcError) Error() string {
+	if e.Data != nil {
+		bytes, _ := json.Marshal(e.Data)
+		return fmt.Sprintf("rpc error %d: %s, data: %s", e.Code, e.Message, bytes)
+	}
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// ToLTable 转换为作为 lua 错误抛出的 table {code=, message=, data=}，tostring 时为错误信息
+func (e *RpcError) ToLTable(vm *lua.LState) *lua.LTable {
+	t := vm.NewTable()
+	SetLTable(t, "code", lua.LNumber(e.Code))
+	SetLTableString(t, "message", e.Message)
+	if e.Data != nil {
+		SetLTable(t, "data", JsonToLValue(vm, e.Data))
+	}
+	setErrorString(vm, t, e.Error())
+	return t
+}
+
+type RpcResponse struct {
+	// Id 规范化后的 id，见 rpcIdKey，为空表示响应没有 id
+	Id     string
+	Result interface{}
+	Error  *RpcError
+}
+
+func NewRpcRequest(method string, params interface{}) *RpcRequest {
+	return &RpcRequest{
+		Jsonrpc: "2.0",
+		Id:      atomic.AddInt64(&rpcId, 1),
+		Method:  method,
+		Params:  params,
+	}
+}
+
+// NewRpcHttpContext 根据 context 构造 POST 请求，body 为单个请求或批量请求数组
+func NewRpcHttpContext(req *HttpContext, body interface{}) (*HttpContext, error) {
+	bytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	httpCtx := req.Clone()
+	httpCtx.Method = "POST"
+	httpCtx.Data = string(bytes)
+	httpCtx.Header.SetFold("Content-Type", "application/json")
+	return httpCtx, nil
+}
+
+// ParseRpcResponses 解析响应，单个响应和批量响应都返回数组
+func ParseRpcResponses(body string) ([]*RpcResponse, error) {
+	v, ok := ParseJson(body)
+	if !ok {
+		return nil, fmt.Errorf("invalid json-rpc response: %s", body)
+	}
+
+	items, ok := v.([]interface{})
+	if !ok {
+		items = []interface{}{v}
+	}
+	res := make([]*RpcResponse, 0, len(items))
+	for _, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid json-rpc response: %s", body)
+		}
+		resp := &RpcResponse{Result: m["result"]}
+		if id, ok := m["id"]; ok && id != nil {
+			resp.Id = rpcIdKey(id)
+		}
+		if e, ok := m["error"].(map[string]interface{}); ok {
+			resp.Error = &RpcError{Data: e["data"]}
+			resp.Error.Message, _ = e["message"].(string)
+			code, err := rpcErrorCode(e["code"])
+			if err != nil {
+				return nil, fmt.Errorf("invalid json-rpc response: %v: %s", err, body)
+			}
+			resp.Error.Code = code
+		}
+		res = append(res, resp)
+	}
+	return res, nil
+}
+
+// rpcIdKey 规范化 id 用于匹配，数值相等的 id（如 1 和 1.0）相同，字符串 id 加引号与数值区分
+func rpcIdKey(id interface{}) string {
+	switch v := id.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return strconv.FormatInt(n, 10)
+		}
+		if f, err := v.Float64(); err == nil {
+			if f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+				return strconv.FormatInt(int64(f), 10)
+			}
+			return strconv.FormatFloat(f, 'g', -1, 64)
+		}
+		return v.String()
+	case string:
+		return strconv.Quote(v)
+	}
+	bytes, _ := json.Marshal(id)
+	return string(bytes)
+}
+
+// rpcErrorCode 解析错误码，缺少时为 0，非整数时返回错误
+func rpcErrorCode(code interface{}) (int64, error) {
+	switch v := code.(type) {
+	case nil:
+		return 0, nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			return int64(f), nil
+		}
+	case string:
+		if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid error code %v", code)
+}
+
+// MatchRpcResponses 按 id 将响应与请求对应，没有 id 的错误响应（如解析失败）对应到所有未匹配的请求
+func MatchRpcResponses(reqs []*RpcRequest, resps []*RpcResponse) []*RpcResponse {
+	byId := make(map[string]*RpcResponse, len(resps))
+	var noId *RpcResponse
+	for _, resp := range resps {
+		if resp.Id == "" {
+			noId = resp
+		} else {
+			byId[resp.Id] = resp
+		}
+	}
+
+	res := make([]*RpcResponse, len(reqs))
+	for i, req := range reqs {
+		id := rpcIdKey(req.Id)
+		if resp, ok := byId[id]; ok {
+			res[i] = resp
+		} else if noId != nil {
+			res[i] = noId
+		} else {
+			res[i] = &RpcResponse{Id: id, Error: &RpcError{Message: fmt.Sprintf("no response for id %d", req.Id)}}
+		}
+	}
+	return res
+}
+
+// RpcBatchError 批量请求中失败的调用
+type RpcBatchError struct {
+	Reqs  []*RpcRequest
+	Resps []*RpcResponse
+}
+
+func (e *RpcBatchError) Error() string {
+	lines := make([]string, 0)
+	for i, resp := range e.Resps {
+		if resp.Error != nil {
+			lines = append(lines, fmt.Sprintf("[%d] %s: %v", i+1, e.Reqs[i].Method, resp.Error))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ToLTable 转换为作为 lua 错误抛出的 table {message=, errors={{index=, method=, code=, message=, data=}, ...}}
+func (e *RpcBatchError) ToLTable(vm *lua.LState) *lua.LTable {
+	errs := vm.NewTable()
+	for i, resp := range e.Resps {
+		if resp.Error != nil {
+			item := resp.Error.ToLTable(vm)
+			SetLTable(item, "index", lua.LNumber(i+1))
+			SetLTableString(item, "method", e.Reqs[i].Method)
+			errs.Append(item)
+		}
+	}
+
+	t := vm.NewTable()
+	SetLTableString(t, "message", e.Error())
+	SetLTable(t, "errors", errs)
+	setErrorString(vm, t, e.Error())
+	return t
+}
@@ -0,0 +1,309 @@
+package lualib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/yuin/gopher-lua"
+)
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "goto": true, "if": true, "in": true,
+	"local": true, "nil": true, "not": true, "or": true, "repeat": true, "return": true,
+	"then": true, "true": true, "until": true, "while": true,
+}
+
+// luaEntry table 中的一个字段，key 为 string 或 float64
+type luaEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+// luaEncoder 将 lua 值或 go 值编码为可以重新加载的 lua 代码
+type luaEncoder struct {
+	buf  bytes.Buffer
+	seen map[*lua.LTable]bool
+}
+
+// ToLuaCode 编码为 lua 代码，支持 lua 值和 go 的 string/number/bool/nil/map/slice
+// 字符串按字节精确转义，数组部分按顺序输出，其余 key 排序后输出，保证结果稳定
+func ToLuaCode(v interface{}) (string, error) {
+	enc := &luaEncoder{seen: make(map[*lua.LTable]bool)}
+	if err := enc.encode(v, ""); err != nil {
+		return "", err
+	}
+	return enc.buf.String(), nil
+}
+
+func LTableToLuaCode(table *lua.LTable) (string, error) {
+	return ToLuaCode(table)
+}
+
+func (enc *luaEncoder) encode(v interface{}, indent string) error {
+	switch v := v.(type) {
+	case nil:
+		enc.buf.WriteString("json.null")
+	case *lua.LNilType:
+		enc.buf.WriteString("nil")
+	case bool:
+		enc.buf.WriteString(strconv.FormatBool(v))
+	case lua.LBool:
+		enc.buf.WriteString(strconv.FormatBool(bool(v)))
+	case string:
+		enc.buf.WriteString(QuoteLuaString(v))
+	case lua.LString:
+		enc.buf.WriteString(QuoteLuaString(string(v)))
+	case int:
+		enc.buf.WriteString(strconv.Itoa(v))
+	case int64:
+		enc.buf.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		enc.buf.WriteString(formatLuaNumber(v))
+	case lua.LNumber:
+		enc.buf.WriteString(formatLuaNumber(float64(v)))
+	case json.Number:
+		enc.buf.WriteString("json.number(" + QuoteLuaString(string(v)) + ")")
+	case *lua.LUserData:
+		switch uv := v.Value.(type) {
+		case jsonNullType:
+			enc.buf.WriteString("json.null")
+		case json.Number:
+			return enc.encode(uv, indent)
+		default:
+			return errors.New("can not encode userdata to lua code")
+		}
+	case *lua.LTable:
+		return enc.encodeLTable(v, indent)
+	case map[string]interface{}:
+		entries := make([]luaEntry, 0, len(v))
+		for k, item := range v {
+			entries = append(entries, luaEntry{key: k, value: item})
+		}
+		return enc.encodeTable(nil, entries, "", indent)
+	case map[string]string:
+		entries := make([]luaEntry, 0, len(v))
+		for k, item := range v {
+			entries = append(entries, luaEntry{key: k, value: item})
+		}
+		return enc.encodeTable(nil, entries, "", indent)
+	case []interface{}:
+		if len(v) == 0 {
+			enc.buf.WriteString("json.array()")
+			return nil
+		}
+		return enc.encodeTable(v, nil, "", indent)
+	case Params:
+		// 使用 {{"key", "value"}, ...} 形式保留顺序和重复的 key，每一对输出在一行
+		if len(v) == 0 {
+			enc.buf.WriteString("{}")
+			return nil
+		}
+		enc.buf.WriteString("{\n")
+		for _, p := range v {
+			enc.buf.WriteString(indent + "\t{" + QuoteLuaString(p.Key) + ", " + QuoteLuaString(p.Value) + "},\n")
+		}
+		enc.buf.WriteString(indent + "}")
+	case []string:
+		items := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			items = append(items, item)
+		}
+		return enc.encodeTable(items, nil, "", indent)
+	default:
+		return fmt.Errorf("can not encode %s to lua code", luaTypeName(v))
+	}
+	return nil
+}
+
+func luaTypeName(v interface{}) string {
+	if lv, ok := v.(lua.LValue); ok {
+		return lv.Type().String()
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// encodeLTable 1..n 的连续部分作为数组输出，json.array()/json.object() 标记保留
+func (enc *luaEncoder) encodeLTable(t *lua.LTable, indent string) error {
+	if enc.seen[t] {
+		return errors.New("can not encode circular table to lua code")
+	}
+	enc.seen[t] = true
+	defer delete(enc.seen, t)
+
+	n := 0
+	for t.RawGetInt(n+1) != lua.LNil {
+		n++
+	}
+	items := make([]interface{}, 0, n)
+	for i := 1; i <= n; i++ {
+		items = append(items, t.RawGetInt(i))
+	}
+
+	var (
+		entries []luaEntry
+		err     error
+	)
+	t.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch k := k.(type) {
+		case lua.LString:
+			entries = append(entries, luaEntry{key: string(k), value: v})
+		case lua.LNumber:
+			if f := float64(k); f != math.Trunc(f) || f < 1 || f > float64(n) {
+				entries = append(entries, luaEntry{key: f, value: v})
+			}
+		default:
+			err = fmt.Errorf("can not encode table key of type %s to lua code", k.Type())
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	wrap := ""
+	switch jsonType(t) {
+	case JSON_TYPE_ARRAY:
+		wrap = "json.array"
+	case JSON_TYPE_OBJECT:
+		wrap = "json.object"
+	}
+	return enc.encodeTable(items, entries, wrap, indent)
+}
+
+// encodeTable 输出 table 构造式，wrap 不为空时输出为 wrap({...})
+func (enc *luaEncoder) encodeTable(items []interface{}, entries []luaEntry, wrap, indent string) error {
+	if len(items) == 0 && len(entries) == 0 {
+		if wrap != "" {
+			enc.buf.WriteString(wrap + "()")
+		} else {
+			enc.buf.WriteString("{}")
+		}
+		return nil
+	}
+	sortLuaEntries(entries)
+
+	if wrap != "" {
+		enc.buf.WriteString(wrap + "(")
+	}
+	enc.buf.WriteString("{\n")
+	inner := indent + "\t"
+	for _, item := range items {
+		enc.buf.WriteString(inner)
+		if err := enc.encode(item, inner); err != nil {
+			return err
+		}
+		enc.buf.WriteString(",\n")
+	}
+	for i, e := range entries {
+		enc.buf.WriteString(inner)
+		enc.buf.WriteString(luaKey(e.key))
+		enc.buf.WriteString(" = ")
+		start := enc.buf.Len()
+		if err := enc.encode(e.value, inner); err != nil {
+			return err
+		}
+		// gopher-lua 将有数组部分的 table 中最后一个字段的函数调用按多返回值展开到数组中，加括号只取一个值
+		if v := enc.buf.String()[start:]; len(items) > 0 && i == len(entries)-1 && strings.HasPrefix(v, "json.") && strings.HasSuffix(v, ")") {
+			enc.buf.Truncate(start)
+			enc.buf.WriteString("(" + v + ")")
+		}
+		enc.buf.WriteString(",\n")
+	}
+	enc.buf.WriteString(indent + "}")
+	if wrap != "" {
+		enc.buf.WriteString(")")
+	}
+	return nil
+}
+
+// sortLuaEntries 数字 key 在前按大小排序，字符串 key 在后按字典序排序
+func sortLuaEntries(entries []luaEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		ki, iNum := entries[i].key.(float64)
+		kj, jNum := entries[j].key.(float64)
+		switch {
+		case iNum && jNum:
+			return ki < kj
+		case iNum != jNum:
+			return iNum
+		}
+		return entries[i].key.(string) < entries[j].key.(string)
+	})
+}
+
+func luaKey(key interface{}) string {
+	if f, ok := key.(float64); ok {
+		return "[" + formatLuaNumber(f) + "]"
+	}
+	s := key.(string)
+	if StringIsIdent(s) && !luaKeywords[s] {
+		return s
+	}
+	return "[" + QuoteLuaString(s) + "]"
+}
+
+// formatLuaNumber 整数不输出小数部分和指数，其他数字输出可以精确还原的最短形式
+// 超过 2^53 的整数在 lua 中本身已经不精确，输出为能还原出同一个值的整数，如 1234567890123456800
+// 需要保留原始数字时使用 json.number
+func formatLuaNumber(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "(0/0)"
+	case math.IsInf(f, 1):
+		// gopher-lua 的 math.huge 是最大的 float64 而不是无穷大
+		return "(1/0)"
+	case math.IsInf(f, -1):
+		return "(-1/0)"
+	case f == math.Trunc(f) && math.Abs(f) < 1e21:
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// QuoteLuaString 转义为 lua 双引号字符串，控制字符和非法的 utf8 字节使用 \ddd 形式
+func QuoteLuaString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch c {
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if c >= utf8.RuneSelf {
+				r, size := utf8.DecodeRuneInString(s[i:])
+				if r == utf8.RuneError && size == 1 {
+					fmt.Fprintf(&b, `\%03d`, c)
+				} else {
+					b.WriteString(s[i : i+size])
+				}
+				i += size
+				continue
+			}
+			if c < 0x20 || c == 0x7f {
+				fmt.Fprintf(&b, `\%03d`, c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+		i++
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,163 @@
+package lualib
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// randLuaString 随机字节串，偏向容易出错的引号、反斜杠、]]、换行和非法 utf8
+func randLuaString(r *rand.Rand) string {
+	pieces := []string{`"`, `'`, `\`, "]]", "[[", "]=]", "\n", "\r\n", "\t", "\x00", "\x7f", "中文", "\xff\xfe", "end", "--"}
+	b := make([]byte, 0, 16)
+	for i, n := 0, r.Intn(16); i < n; i++ {
+		if r.Intn(3) == 0 {
+			b = append(b, pieces[r.Intn(len(pieces))]...)
+		} else {
+			b = append(b, byte(r.Intn(256)))
+		}
+	}
+	return string(b)
+}
+
+func randLuaNumber(r *rand.Rand) lua.LNumber {
+	switch r.Intn(6) {
+	case 0:
+		return lua.LNumber(r.Intn(2000) - 1000)
+	case 1:
+		return lua.LNumber(r.NormFloat64() * 1e6)
+	case 2:
+		// 超过 2^53 的整数
+		return lua.LNumber(float64(r.Int63()) * float64(1+r.Intn(1000)))
+	case 3:
+		return lua.LNumber(math.Float64frombits(r.Uint64() &^ (0x7ff << 52)))
+	case 4:
+		return lua.LNumber(math.Inf(1 - 2*r.Intn(2)))
+	}
+	return lua.LNumber(r.ExpFloat64() * 1e-300)
+}
+
+func randLuaKey(r *rand.Rand) lua.LValue {
+	switch r.Intn(4) {
+	case 0:
+		return randLuaNumber(r)
+	case 1:
+		keys := []string{"a", "_x1", "end", "nil", "true", "1", "a b", ""}
+		return lua.LString(keys[r.Intn(len(keys))])
+	}
+	return lua.LString(randLuaString(r))
+}
+
+func randLuaValue(vm *lua.LState, r *rand.Rand, depth int) lua.LValue {
+	n := 6
+	if depth <= 0 {
+		n = 4
+	}
+	switch r.Intn(n) {
+	case 0:
+		return lua.LBool(r.Intn(2) == 0)
+	case 1:
+		return randLuaNumber(r)
+	case 2:
+		return lua.LString(randLuaString(r))
+	case 3:
+		if r.Intn(2) == 0 {
+			return JsonNull
+		}
+		return newJsonNumber(vm, "12345678901234567890")
+	}
+
+	t := vm.NewTable()
+	for i, size := 0, r.Intn(5); i < size; i++ {
+		t.Append(randLuaValue(vm, r, depth-1))
+	}
+	for i, size := 0, r.Intn(5); i < size; i++ {
+		t.RawSet(randLuaKey(r), randLuaValue(vm, r, depth-1))
+	}
+	switch r.Intn(4) {
+	case 0:
+		vm.SetMetatable(t, jsonMarkerTable(vm, JSON_TYPE_ARRAY))
+	case 1:
+		vm.SetMetatable(t, jsonMarkerTable(vm, JSON_TYPE_OBJECT))
+	}
+	return t
+}
+
+func jsonMarkerTable(vm *lua.LState, typ string) *lua.LTable {
+	mt := vm.NewTable()
+	mt.RawSetString(JSON_TYPE_FIELD, lua.LString(typ))
+	return mt
+}
+
+// equalLValue 比较编码前后的值，json.number 比较数字文本，table 比较所有字段和 json 标记
+func equalLValue(a, b lua.LValue) bool {
+	switch a := a.(type) {
+	case lua.LNumber:
+		bn, ok := b.(lua.LNumber)
+		return ok && (a == bn || math.IsNaN(float64(a)) && math.IsNaN(float64(bn)))
+	case *lua.LUserData:
+		bu, ok := b.(*lua.LUserData)
+		return ok && a.Value == bu.Value
+	case *lua.LTable:
+		bt, ok := b.(*lua.LTable)
+		if !ok || jsonType(a) != jsonType(bt) {
+			return false
+		}
+		equal := true
+		count := 0
+		a.ForEach(func(k, v lua.LValue) {
+			count++
+			equal = equal && equalLValue(v, bt.RawGet(k))
+		})
+		bt.ForEach(func(k, v lua.LValue) {
+			count--
+		})
+		return equal && count == 0
+	}
+	return a == b
+}
+
+// TestToLuaCodeRoundTrip 随机生成的值编码为 lua 代码后重新加载，应与原值相同
+// 超过 2^53 的整数在 lua 中已经不精确，编码为能还原出同一个 float64 的整数，如 1234567890123456800
+func TestToLuaCodeRoundTrip(t *testing.T) {
+	vm := lua.NewState()
+	defer vm.Close()
+	RegisterJsonModule(vm)
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		v := randLuaValue(vm, r, 3)
+		code, err := ToLuaCode(v)
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if err := vm.DoString("v = " + code); err != nil {
+			t.Fatalf("case %d: %v\n%s", i, err, code)
+		}
+		if got := vm.GetGlobal("v"); !equalLValue(v, got) {
+			t.Fatalf("case %d: round trip mismatch\n%s", i, code)
+		}
+	}
+}
+
+func TestFormatLuaNumber(t *testing.T) {
+	cases := map[float64]string{
+		0:                      "0",
+		-12:                    "-12",
+		0.1:                    "0.1",
+		1 << 53:                "9007199254740992",
+		1234567890123456789:    "1234567890123456800",
+		1e21:                   "1e+21",
+		math.Inf(-1):           "(-1/0)",
+		1.5e-300:               "1.5e-300",
+		-9007199254740993.0:    "-9007199254740992",
+		float64(math.MaxInt64): "9223372036854776000",
+	}
+	for f, want := range cases {
+		if got := formatLuaNumber(f); got != want {
+			t.Errorf("formatLuaNumber(%v) = %s, want %s", f, got, want)
+		}
+	}
+}
@@ -1,9 +1,15 @@
 package lualib
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 
+	"github.com/gorilla/websocket"
 	"github.com/yuin/gopher-lua"
 )
 
@@ -25,6 +31,42 @@ var (
 		"json_encode": json_encode,
 		"shell":       shell,
 		"help":        help,
+
+		"import_postman":  import_postman,
+		"history":         history,
+		"history_persist": history_persist,
+		"last":            last,
+		"resp":            resp,
+		"resend":          resend,
+		"diff":            diff,
+		"compare":         compare,
+		"bench":           bench,
+		"send_async":      send_async,
+		"wait":            wait,
+		"wait_all":        wait_all,
+		"batch":           batch,
+		"serve":           serve,
+		"serve_stop":      serve_stop,
+		"cassette":        cassette,
+		"cassette_stop":   cassette_stop,
+		"proxy":           proxy,
+		"proxy_stop":      proxy_stop,
+		"use":             use,
+		"with_context":    with_context,
+		"ctx_new":         ctx_new,
+		"ctx_use":         ctx_use,
+		"ctx_list":        ctx_list,
+		"ctx_copy":        ctx_copy,
+		"sse":             sse,
+		"stream":          stream,
+		"ws":              ws,
+		"ws_connect":      ws_connect,
+		"grpc":            grpc_call,
+		"graphql":         graphql,
+		"graphql_schema":  graphql_schema,
+		"rpc":             rpc,
+		"rpc_batch":       rpc_batch,
+		"output":          output,
 	}
 )
 
@@ -32,6 +74,8 @@ func RegisterFuncs(vm *lua.LState) {
 	for fnName, fn := range FuncsMap {
 		vm.SetGlobal(fnName, vm.NewFunction(fn))
 	}
+	RegisterWsType(vm)
+	RegisterJsonModule(vm)
 }
 
 func reset(vm *lua.LState) int {
@@ -131,7 +175,7 @@ func debug(vm *lua.LState) int {
 	return 0
 }
 
-func send0(vm *lua.LState, method string, header map[string]string, formatJson bool) (nres int) {
+func send0(vm *lua.LState, method string, prepare func(httpCtx *HttpContext), formatJson bool) (nres int) {
 	defer func() {
 		if err := recover(); err != nil {
 			vm.RaiseError("call send error: %v", err)
@@ -144,51 +188,70 @@ func send0(vm *lua.LState, method string, header map[string]string, formatJson b
 		return 1
 	}
 
-	httpCtx := NewHttpContext()
-	httpCtx.Url = GetLTableString(ctx, "url", "")
-	httpCtx.Data = GetLTableString(ctx, "data", "")
-	httpCtx.Query = LTableToMapString(GetLTableTable(ctx, "query"))
-
-	httpCtx.Header = LTableToMapString(GetLTableTable(ctx, "header"))
-	if len(header) > 0 {
-		for k, v := range header {
-			httpCtx.Header[k] = v
-		}
+	httpCtx, ok := CheckContextToHttpContext(vm, ctx, GetVars(vm))
+	if !ok {
+		return 1
 	}
-
-	if method == "" {
-		httpCtx.Method = GetLTableString(ctx, "method", "GET")
-	} else {
+	if prepare != nil {
+		prepare(httpCtx)
+	}
+	if method != "" {
 		httpCtx.Method = method
 	}
 
-	bodyStr, err := httpCtx.Send()
+	var (
+		resp *HttpResponse
+		err  error
+	)
+	Unblock(func() { resp, err = httpCtx.Send() })
 	if err != nil {
 		panic(err)
 	}
+	DefaultHistory.Add(httpCtx, resp)
 
-	if formatJson {
-		fmt.Println(JsonPrettyFormat(bodyStr))
-	} else {
-		fmt.Println(bodyStr)
-	}
+	PrintResponseBody(resp, formatJson)
 	return 0
 }
 
+// sendWithArgs 处理 send 系列函数的参数 ([name|table], [bool])，指定 context 时使用它发送而不是全局变量 context
+func sendWithArgs(vm *lua.LState, method string, prepare func(httpCtx *HttpContext)) int {
+	ctx, ok := CheckGetContextArg(vm, 1)
+	if !ok {
+		return 1
+	}
+	n := 1
+	if ctx != nil {
+		n = 2
+	}
+	formatJson := vm.GetTop() >= n && vm.CheckBool(n)
+	if ctx == nil {
+		return send0(vm, method, prepare, formatJson)
+	}
+
+	nres := 0
+	useContext(vm, ctx, vm.GetGlobal("context"), func() {
+		nres = send0(vm, method, prepare, formatJson)
+	})
+	return nres
+}
+
 func send(vm *lua.LState) int {
-	return send0(vm, "", nil, vm.GetTop() > 0 && vm.CheckBool(1))
+	return sendWithArgs(vm, "", nil)
 }
 
 func send_get(vm *lua.LState) int {
-	return send0(vm, "GET", nil, vm.GetTop() > 0 && vm.CheckBool(1))
+	return sendWithArgs(vm, "GET", nil)
 }
 
 func send_post(vm *lua.LState) int {
-	return send0(vm, "POST", nil, vm.GetTop() > 0 && vm.CheckBool(1))
+	return sendWithArgs(vm, "POST", nil)
 }
 
 func send_form(vm *lua.LState) int {
-	return send0(vm, "POST", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, vm.GetTop() > 0 && vm.CheckBool(1))
+	// query 总是放在 url 上，表单 body 来自 context.form
+	return sendWithArgs(vm, "POST", func(httpCtx *HttpContext) {
+		httpCtx.Header.SetFold("Content-Type", "application/x-www-form-urlencoded")
+	})
 }
 
 func send_lua(vm *lua.LState) int {
@@ -196,48 +259,23 @@ func send_lua(vm *lua.LState) int {
 		return 1
 	}
 
-	ctx, ok := CheckGetContext(vm)
-	if !ok {
-		return 1
-	}
-
-	tmpLuaFile := "/tmp/icurl.lua"
-
-	// 1. save to temporary file
-	strcode, err := LTableToLuaCode(ctx)
-	if err != nil {
-		vm.RaiseError("%v", err)
-		return 1
-	}
-	if err := ioutil.WriteFile(tmpLuaFile, []byte("context = "+strcode), 0644); err != nil {
-		vm.RaiseError("write file error: %v", err)
-		return 1
-	}
-
-	// 2. call lua file
 	fpath := GetRealPath(GetBasePath() + "/" + vm.ToString(1))
 	if !FileExists(fpath) {
 		return 0
 	}
-	err = RunLuaFile(vm, fpath)
-	if err != nil {
-		vm.RaiseError("call lua file error: %v", err)
-		return 1
-	}
-
-	// 3. send request
-	nres := send0(vm, "", nil, vm.GetTop() > 1 && vm.CheckBool(2))
-	if nres > 0 {
-		return nres
-	}
+	formatJson := vm.GetTop() > 1 && vm.CheckBool(2)
 
-	// 4. restore from temporary file
-	err = RunLuaFile(vm, tmpLuaFile)
-	if err != nil {
-		vm.RaiseError("call lua file error: %v", err)
-		return 1
-	}
-	return 0
+	// 在 context 的副本中执行 lua 文件并发送请求，结束后恢复 context
+	nres := 0
+	WithContext(vm, nil, func() {
+		if err := RunLuaFile(vm, fpath); err != nil {
+			vm.RaiseError("call lua file error: %v", err)
+			nres = 1
+			return
+		}
+		nres = send0(vm, "", nil, formatJson)
+	})
+	return nres
 }
 
 func set_query(vm *lua.LState) int {
@@ -308,7 +346,11 @@ func shell(vm *lua.LState) int {
 	}
 
 	cmdStr := vm.CheckString(1)
-	out, err := ShellExec(cmdStr)
+	var (
+		out string
+		err error
+	)
+	Unblock(func() { out, err = ShellExec(cmdStr) })
 	if err != nil {
 		vm.RaiseError("shell error: %v", err)
 		return 1
@@ -317,15 +359,993 @@ func shell(vm *lua.LState) int {
 	return 0
 }
 
+func import_postman(vm *lua.LState) int {
+	if !CheckArg(vm, 1, "too few args, need postman collection or environment filepath") {
+		return 1
+	}
+
+	overwrite := vm.GetTop() > 1 && vm.CheckBool(2)
+	files, err := ImportPostman(GetRealPath(vm.CheckString(1)), overwrite)
+	for _, f := range files {
+		fmt.Println(f)
+	}
+	if err != nil {
+		vm.RaiseError("import postman error: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func history(vm *lua.LState) int {
+	n := 0
+	if vm.GetTop() > 0 {
+		n = vm.CheckInt(1)
+	}
+
+	for _, entry := range DefaultHistory.Entries(n) {
+		fmt.Println(entry)
+	}
+	return 0
+}
+
+func history_persist(vm *lua.LState) int {
+	if vm.GetTop() > 0 && !vm.CheckBool(1) {
+		DefaultHistory.Unpersist()
+		return 0
+	}
+
+	fpath := GetRealPath(GetBasePath() + "/" + HISTORY_FILE)
+	if err := DefaultHistory.Persist(fpath); err != nil {
+		vm.RaiseError("history persist error: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func last(vm *lua.LState) int {
+	entry, ok := DefaultHistory.Last()
+	if !ok {
+		vm.Push(lua.LNil)
+		return 1
+	}
+	vm.Push(entry.ToLTable(vm))
+	return 1
+}
+
+func resp(vm *lua.LState) int {
+	entry, ok := CheckGetHistoryEntry(vm, 1)
+	if !ok {
+		return 1
+	}
+	vm.Push(entry.ToLTable(vm))
+	return 1
+}
+
+func resend(vm *lua.LState) (nres int) {
+	defer func() {
+		if err := recover(); err != nil {
+			vm.RaiseError("call resend error: %v", err)
+			nres = 1
+		}
+	}()
+
+	entry, ok := CheckGetHistoryEntry(vm, 1)
+	if !ok {
+		return 1
+	}
+	if entry.Truncated {
+		vm.RaiseError("history entry %d was truncated by proxy, can not be resent", entry.Id)
+		return 1
+	}
+
+	var (
+		resp *HttpResponse
+		err  error
+	)
+	Unblock(func() { resp, err = entry.Request.Send() })
+	if err != nil {
+		panic(err)
+	}
+	DefaultHistory.Add(entry.Request, resp)
+
+	PrintResponseBody(resp, vm.GetTop() > 1 && vm.CheckBool(2))
+	return 0
+}
+
+func diff(vm *lua.LState) int {
+	a, ok := CheckGetHistoryEntry(vm, 1)
+	if !ok {
+		return 1
+	}
+	b, ok := CheckGetHistoryEntry(vm, 2)
+	if !ok {
+		return 1
+	}
+
+	if a.Response.StatusCode != b.Response.StatusCode {
+		fmt.Printf("~ status: %d => %d\n", a.Response.StatusCode, b.Response.StatusCode)
+	}
+	items := DiffBody(a.Response.Body, b.Response.Body)
+	for _, item := range items {
+		fmt.Println(item)
+	}
+	if len(items) == 0 && a.Response.StatusCode == b.Response.StatusCode {
+		fmt.Println("no difference")
+	}
+	return 0
+}
+
+func compare(vm *lua.LState) int {
+	if !CheckArg(vm, 2, "too few args, need two env names or base urls") {
+		return 1
+	}
+
+	envA := vm.CheckString(1)
+	envB := vm.CheckString(2)
+	var ignore []string
+	if vm.GetTop() > 2 {
+		ignore = LTableToStringSlice(vm.CheckTable(3))
+	}
+
+	ctx, ok := CheckGetContext(vm)
+	if !ok {
+		return 1
+	}
+
+	res, err := Compare(vm, ctx, envA, envB, ignore)
+	if err != nil {
+		vm.RaiseError("compare error: %v", err)
+		return 1
+	}
+	fmt.Println(res)
+	vm.Push(lua.LBool(res.Same()))
+	return 1
+}
+
+func bench(vm *lua.LState) int {
+	var (
+		opts BenchOptions
+		tab  *lua.LTable
+	)
+	if vm.GetTop() > 0 {
+		tab = vm.CheckTable(1)
+		var err error
+		if opts, err = LTableToBenchOptions(tab); err != nil {
+			vm.RaiseError("bench error: %v", err)
+			return 1
+		}
+	}
+
+	ctx, ok := CheckGetContextOpt(vm, tab)
+	if !ok {
+		return 1
+	}
+
+	req, ok := CheckContextToHttpContext(vm, ctx, GetVars(vm))
+	if !ok {
+		return 1
+	}
+	var res *BenchResult
+	Unblock(func() { res = Bench(req, opts) })
+	fmt.Println(res)
+	if opts.Output != "" {
+		if err := res.WriteFile(GetRealPath(opts.Output)); err != nil {
+			vm.RaiseError("bench write file error: %v", err)
+			return 1
+		}
+	}
+	vm.Push(res.Summary().ToLTable(vm))
+	return 1
+}
+
+func send_async(vm *lua.LState) int {
+	ctx, ok := CheckGetContextArg(vm, 1)
+	if ok && ctx == nil {
+		ctx, ok = CheckGetContext(vm)
+	}
+	if !ok {
+		return 1
+	}
+
+	req, ok := CheckContextToHttpContext(vm, ctx, GetVars(vm))
+	if !ok {
+		return 1
+	}
+	h := DefaultAsyncPool.Go(req, nil)
+	vm.Push(lua.LNumber(h.Id))
+	return 1
+}
+
+func wait(vm *lua.LState) int {
+	if !CheckArg(vm, 1, "too few args, need handles returned by send_async") {
+		return 1
+	}
+
+	handles := make([]*AsyncHandle, 0, vm.GetTop())
+	for i := 1; i <= vm.GetTop(); i++ {
+		id := vm.CheckInt(i)
+		h, ok := DefaultAsyncPool.Take(id)
+		if !ok {
+			vm.RaiseError("async handle %d not exists", id)
+			return 1
+		}
+		handles = append(handles, h)
+	}
+
+	for _, h := range handles {
+		Unblock(h.Wait)
+		PrintAsyncHandle(h)
+		vm.Push(h.ToLTable(vm))
+	}
+	return len(handles)
+}
+
+func wait_all(vm *lua.LState) int {
+	res := vm.NewTable()
+	for _, h := range DefaultAsyncPool.TakeAll() {
+		Unblock(h.Wait)
+		PrintAsyncHandle(h)
+		res.Append(h.ToLTable(vm))
+	}
+	vm.Push(res)
+	return 1
+}
+
+func batch(vm *lua.LState) int {
+	if !CheckArg(vm, 1, "too few args, need table of contexts") {
+		return 1
+	}
+
+	tab := vm.CheckTable(1)
+	vars := GetVars(vm)
+	reqs := make([]*HttpContext, 0, tab.Len())
+	for i := 1; i <= tab.Len(); i++ {
+		ctx, ok := tab.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			vm.RaiseError("batch item %d must be table", i)
+			return 1
+		}
+		req, err := ContextToHttpContext(ctx, vars)
+		if err != nil {
+			vm.RaiseError("batch item %d: %v", i, err)
+			return 1
+		}
+		reqs = append(reqs, req)
+	}
+
+	res := vm.NewTable()
+	var handles []*AsyncHandle
+	Unblock(func() { handles = Batch(reqs, GetLTableInt(tab, "concurrency")) })
+	for _, h := range handles {
+		PrintAsyncHandle(h)
+		res.Append(h.ToLTable(vm))
+	}
+	vm.Push(res)
+	return 1
+}
+
+func serve(vm *lua.LState) int {
+	if !CheckArg(vm, 1, "too few args, need table {port, routes, mocks}") {
+		return 1
+	}
+
+	tab := vm.CheckTable(1)
+	routesTab := vm.NewTable()
+
+	var mocks []string
+	switch v := tab.RawGetString("mocks").(type) {
+	case lua.LString:
+		mocks = []string{string(v)}
+	case *lua.LTable:
+		mocks = LTableToStringSlice(v)
+	}
+	if len(mocks) > 0 {
+		loaded, err := LoadMockRoutes(vm, mocks)
+		if err != nil {
+			vm.RaiseError("serve load mocks error: %v", err)
+			return 1
+		}
+		loaded.ForEach(func(k, v lua.LValue) { routesTab.RawSet(k, v) })
+	}
+	if t := GetLTableTable(tab, "routes"); t != nil {
+		t.ForEach(func(k, v lua.LValue) { routesTab.RawSet(k, v) })
+	}
+
+	routes, err := LTableToMockRoutes(routesTab)
+	if err != nil {
+		vm.RaiseError("serve error: %v", err)
+		return 1
+	}
+
+	server, err := StartMockServer(vm, GetLTableString(tab, "host"), GetLTableInt(tab, "port", 8080), routes)
+	if err != nil {
+		vm.RaiseError("serve error: %v", err)
+		return 1
+	}
+	Diagf("=== Mock server listening on %s\n", net.JoinHostPort(server.Host, strconv.Itoa(server.Port)))
+	for _, route := range routes {
+		Diagf("%s\n", route.Key)
+	}
+	vm.Push(lua.LNumber(server.Port))
+	return 1
+}
+
+func serve_stop(vm *lua.LState) int {
+	port := 0
+	if vm.GetTop() > 0 {
+		port = vm.CheckInt(1)
+	}
+
+	var ports []int
+	Unblock(func() { ports = StopMockServer(port) })
+	for _, p := range ports {
+		Diagf("=== Mock server :%d stopped\n", p)
+	}
+	return 0
+}
+
+func cassette(vm *lua.LState) int {
+	if !CheckArg(vm, 1, "too few args, need cassette name") {
+		return 1
+	}
+
+	name := vm.CheckString(1)
+	var opts CassetteOptions
+	if vm.GetTop() > 1 {
+		opts = LTableToCassetteOptions(vm.CheckTable(2))
+	}
+
+	c, err := OpenCassette(name, opts)
+	if err != nil {
+		vm.RaiseError("cassette error: %v", err)
+		return 1
+	}
+	UseCassette(c)
+	Diagf("=== Cassette %s, mode %s, %d interactions\n", c.Name, c.Mode(), len(c.Interactions))
+	return 0
+}
+
+func cassette_stop(vm *lua.LState) int {
+	UseCassette(nil)
+	return 0
+}
+
+func proxy(vm *lua.LState) int {
+	listen, mitm := PROXY_DEFAULT_ADDR, true
+	if vm.GetTop() > 0 {
+		tab := vm.CheckTable(1)
+		listen = GetLTableString(tab, "listen", listen)
+		if v, ok := tab.RawGetString("mitm").(lua.LBool); ok {
+			mitm = bool(v)
+		}
+	}
+
+	p, err := StartProxy(listen, mitm)
+	if err != nil {
+		vm.RaiseError("proxy error: %v", err)
+		return 1
+	}
+	PrintProxyInfo(p)
+	return 0
+}
+
+func proxy_stop(vm *lua.LState) int {
+	var stopped bool
+	Unblock(func() { stopped = StopProxy() })
+	if stopped {
+		Diagf("=== Proxy stopped\n")
+	}
+	return 0
+}
+
+func use(vm *lua.LState) int {
+	entry, ok := CheckGetHistoryEntry(vm, 1)
+	if !ok {
+		return 1
+	}
+	if entry.Truncated {
+		fmt.Fprintf(os.Stderr, "=== Warning: body of history entry %d was truncated to %d bytes by proxy\n", entry.Id, PROXY_MAX_BODY)
+	}
+
+	ctx := vm.NewTable()
+	SetLTableString(ctx, "method", strings.ToUpper(entry.Request.Method))
+	SetLTableString(ctx, "url", entry.Request.Url)
+	SetLTableString(ctx, "data", entry.Request.Data)
+	SetLTable(ctx, "query", ParamsToLTable(vm, entry.Request.Query))
+	SetLTable(ctx, "header", ParamsToLTable(vm, entry.Request.Header))
+	if len(entry.Request.Form) > 0 {
+		SetLTable(ctx, "form", ParamsToLTable(vm, entry.Request.Form))
+	}
+	if v, ok := ParseJson(entry.Request.Json); ok {
+		SetLTable(ctx, "json", JsonToLValueExact(vm, v))
+	}
+	if entry.Request.UnixSocket != "" {
+		SetLTableString(ctx, "unix_socket", entry.Request.UnixSocket)
+	}
+	if len(entry.Request.Resolve) > 0 {
+		resolve := vm.NewTable()
+		for k, v := range entry.Request.Resolve {
+			host, port, _ := net.SplitHostPort(k)
+			addr, _, _ := net.SplitHostPort(v)
+			resolve.Append(lua.LString(host + ":" + port + ":" + addr))
+		}
+		SetLTable(ctx, "resolve", resolve)
+	}
+	if entry.Request.HttpVersion != "" {
+		SetLTableString(ctx, "http_version", entry.Request.HttpVersion)
+	}
+	if entry.Request.Compressed {
+		SetLTable(ctx, "compressed", lua.LTrue)
+	}
+	if entry.Request.GzipRequest {
+		SetLTable(ctx, "gzip_request", lua.LTrue)
+	}
+	if entry.Request.Retry != nil {
+		SetLTable(ctx, "retry", entry.Request.Retry.ToLTable(vm))
+	}
+	vm.SetGlobal("context", ctx)
+	return 0
+}
+
+func sse(vm *lua.LState) int {
+	var (
+		fn        *lua.LFunction
+		tab       *lua.LTable
+		reconnect = true
+	)
+	if vm.GetTop() > 0 {
+		switch v := vm.Get(1).(type) {
+		case *lua.LFunction:
+			fn = v
+		case *lua.LTable:
+			tab = v
+			fn, _ = v.RawGetString("callback").(*lua.LFunction)
+			if b, ok := v.RawGetString("reconnect").(lua.LBool); ok {
+				reconnect = bool(b)
+			}
+		default:
+			vm.ArgError(1, "function or table expected")
+			return 1
+		}
+	}
+
+	ctx, ok := CheckGetContextOpt(vm, tab)
+	if !ok {
+		return 1
+	}
+	req, ok := CheckContextToHttpContext(vm, ctx, GetVars(vm))
+	if !ok {
+		return 1
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopInterrupt := OnInterrupt(cancel)
+	defer stopInterrupt()
+
+	var err error
+	events := make(chan *SSEEvent)
+	go func() {
+		err = RunSSE(c, req, reconnect, events)
+		close(events)
+	}()
+
+	var callErr error
+	for {
+		var (
+			ev *SSEEvent
+			ok bool
+		)
+		Unblock(func() { ev, ok = <-events })
+		if !ok {
+			break
+		}
+		fmt.Println(ev)
+		if fn != nil && callErr == nil && c.Err() == nil {
+			if callErr = CallStreamCallback(vm, fn, ev.ToLTable(vm)); callErr != nil || vm.Get(-1) == lua.LFalse {
+				cancel()
+			}
+			vm.Pop(1)
+		}
+	}
+
+	if callErr != nil {
+		vm.RaiseError("sse callback error: %v", callErr)
+		return 1
+	}
+	if err != nil {
+		vm.RaiseError("sse error: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func stream(vm *lua.LState) int {
+	var fn *lua.LFunction
+	if vm.GetTop() > 0 {
+		fn = vm.CheckFunction(1)
+	}
+
+	ctx, ok := CheckGetContext(vm)
+	if !ok {
+		return 1
+	}
+	req, ok := CheckContextToHttpContext(vm, ctx, GetVars(vm))
+	if !ok {
+		return 1
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopInterrupt := OnInterrupt(cancel)
+	defer stopInterrupt()
+
+	var err error
+	lines := make(chan string)
+	go func() {
+		err = RunStream(c, req, lines)
+		close(lines)
+	}()
+
+	var callErr error
+	for {
+		var (
+			line string
+			ok   bool
+		)
+		Unblock(func() { line, ok = <-lines })
+		if !ok {
+			break
+		}
+		fmt.Println(line)
+		if fn != nil && callErr == nil && c.Err() == nil {
+			if callErr = CallStreamCallback(vm, fn, lua.LString(line)); callErr != nil || vm.Get(-1) == lua.LFalse {
+				cancel()
+			}
+			vm.Pop(1)
+		}
+	}
+
+	if callErr != nil {
+		vm.RaiseError("stream callback error: %v", callErr)
+		return 1
+	}
+	if err != nil {
+		vm.RaiseError("stream error: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// checkWsArgs 解析 ([url], [table])，省略 url 时使用 context.url 和 context.header
+func checkWsArgs(vm *lua.LState) (string, WsOptions) {
+	var (
+		url  string
+		opts WsOptions
+		vars = GetVars(vm)
+	)
+	for i := 1; i <= vm.GetTop() && i <= 2; i++ {
+		switch v := vm.Get(i).(type) {
+		case lua.LString:
+			url = string(v)
+		case *lua.LTable:
+			opts = LTableToWsOptions(v)
+		default:
+			vm.ArgError(i, "string or table expected")
+		}
+	}
+
+	if url == "" {
+		ctx, ok := CheckGetContext(vm)
+		if !ok {
+			return "", opts
+		}
+		req, ok := CheckContextToHttpContext(vm, ctx, vars)
+		if !ok {
+			return "", opts
+		}
+		url = req.buildUrl()
+		if opts.Header == nil {
+			opts.Header = req.Header
+		}
+	}
+	return WsUrl(ExpandVars(url, vars)), WsOptions{
+		Header:       opts.Header.Expand(vars),
+		Subprotocols: opts.Subprotocols,
+		OnMessage:    opts.OnMessage,
+	}
+}
+
+func ws(vm *lua.LState) int {
+	url, opts := checkWsArgs(vm)
+
+	var (
+		c       *WsConn
+		err     error
+		handler = WsMessageHandler(vm, opts.OnMessage, true)
+	)
+	Unblock(func() { c, err = DialWs(url, opts.Header, opts.Subprotocols, handler) })
+	if err != nil {
+		vm.RaiseError("ws connect error: %v", err)
+		return 1
+	}
+	Diagf("=== Connected to %s", url)
+	if p := c.Subprotocol(); p != "" {
+		Diagf(", subprotocol: %s", p)
+	}
+	Diagf("\n=== /ping [data], /binary <hex>, /text <string>, /close [code] [reason], Ctrl-C to quit\n")
+
+	for !c.Closed() {
+		var line string
+		Unblock(func() { line, err = Prompter(WS_PROMPT) })
+		if err != nil {
+			break
+		}
+		if c.Closed() {
+			break
+		}
+		if line == "" {
+			continue
+		}
+
+		var quit bool
+		Unblock(func() { quit, err = c.RunWsCommand(line) })
+		if err != nil {
+			fmt.Printf("ws error: %v\n", err)
+		}
+		if quit {
+			break
+		}
+	}
+
+	Unblock(func() { c.Close(websocket.CloseNormalClosure, "") })
+	return 0
+}
+
+func ws_connect(vm *lua.LState) int {
+	url, opts := checkWsArgs(vm)
+
+	var handler func(c *WsConn, msg *WsMessage)
+	if opts.OnMessage != nil {
+		handler = WsMessageHandler(vm, opts.OnMessage, false)
+	}
+
+	var (
+		c   *WsConn
+		err error
+	)
+	Unblock(func() { c, err = DialWs(url, opts.Header, opts.Subprotocols, handler) })
+	if err != nil {
+		vm.RaiseError("ws connect error: %v", err)
+		return 1
+	}
+	vm.Push(NewWsConnUserData(vm, c))
+	return 1
+}
+
+func grpc_call(vm *lua.LState) int {
+	tab := vm.CheckTable(1)
+	formatJson := vm.OptBool(2, false)
+
+	ctx, _ := GetContext(vm)
+	req, err := LTableToGrpcRequest(tab, ctx, GetVars(vm))
+	if err != nil {
+		vm.RaiseError("grpc error: %v", err)
+		return 1
+	}
+
+	var resp *GrpcResponse
+	Unblock(func() { resp, err = req.Send() })
+	if err != nil {
+		vm.RaiseError("grpc error: %v", err)
+		return 1
+	}
+
+	for _, body := range resp.Bodies {
+		PrintOutputBody(body, formatJson)
+	}
+	vm.Push(resp.ToLTable(vm))
+	return 1
+}
+
+func graphql(vm *lua.LState) int {
+	tab := vm.CheckTable(1)
+	formatJson := vm.OptBool(2, false)
+
+	ctx, ok := CheckGetContextOpt(vm, tab)
+	if !ok {
+		return 1
+	}
+	vars := GetVars(vm)
+	req, ok := CheckContextToHttpContext(vm, ctx, vars)
+	if !ok {
+		return 1
+	}
+
+	gql := &GraphqlRequest{
+		Query:         GetLTableString(tab, "query"),
+		OperationName: GetLTableString(tab, "operation"),
+	}
+	if gql.Query == "" {
+		vm.ArgError(1, "query is required")
+		return 1
+	}
+	var err error
+	switch v := tab.RawGetString("variables").(type) {
+	case *lua.LTable:
+		gql.Variables, err = LTableToMap(v)
+	case lua.LString:
+		gql.Variables, err = GraphqlVariablesFromJson(ExpandVars(string(v), vars))
+	}
+	if err != nil {
+		vm.RaiseError("graphql error: %v", err)
+		return 1
+	}
+	// 加载已缓存的 schema，用于补全
+	LoadGraphqlSchema(req.Url)
+
+	if GraphqlOperationType(gql.Query, gql.OperationName) == "subscription" {
+		fn, _ := tab.RawGetString("callback").(*lua.LFunction)
+		return graphqlSubscribe(vm, req, gql, fn, formatJson)
+	}
+
+	httpCtx, err := NewGraphqlHttpContext(req, gql)
+	if err != nil {
+		vm.RaiseError("graphql error: %v", err)
+		return 1
+	}
+
+	var resp *HttpResponse
+	Unblock(func() { resp, err = httpCtx.Send() })
+	if err != nil {
+		vm.RaiseError("graphql error: %v", err)
+		return 1
+	}
+	DefaultHistory.Add(httpCtx, resp)
+
+	gqlResp, err := ParseGraphqlResponse(resp.Body)
+	if err != nil {
+		PrintOutputBody(resp.Body, formatJson)
+		vm.RaiseError("graphql error: %v", err)
+		return 1
+	}
+	gqlResp.Print(formatJson)
+
+	res := vm.NewTable()
+	SetLTable(res, "status", lua.LNumber(resp.StatusCode))
+	SetLTableString(res, "body", resp.Body)
+	if v, ok := ParseJson(resp.Body); ok {
+		if m, ok := v.(map[string]interface{}); ok {
+			SetLTable(res, "data", JsonToLValue(vm, m["data"]))
+			SetLTable(res, "errors", JsonToLValue(vm, m["errors"]))
+		}
+	}
+	vm.Push(res)
+	return 1
+}
+
+func graphqlSubscribe(vm *lua.LState, req *HttpContext, gql *GraphqlRequest, fn *lua.LFunction, formatJson bool) int {
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopInterrupt := OnInterrupt(cancel)
+	defer stopInterrupt()
+
+	var err error
+	results := make(chan *GraphqlResponse)
+	go func() {
+		err = RunGraphqlSubscription(c, req, gql, results)
+		close(results)
+	}()
+
+	var callErr error
+	for {
+		var (
+			resp *GraphqlResponse
+			ok   bool
+		)
+		Unblock(func() { resp, ok = <-results })
+		if !ok {
+			break
+		}
+		resp.Print(formatJson)
+		if fn != nil && callErr == nil && c.Err() == nil {
+			arg := vm.NewTable()
+			if v, ok := ParseJson(string(resp.Data)); ok {
+				SetLTable(arg, "data", JsonToLValue(vm, v))
+			}
+			if len(resp.Errors) > 0 {
+				errs := vm.NewTable()
+				for _, e := range resp.Errors {
+					errs.Append(lua.LString(e.String()))
+				}
+				SetLTable(arg, "errors", errs)
+			}
+			if callErr = CallStreamCallback(vm, fn, arg); callErr != nil || vm.Get(-1) == lua.LFalse {
+				cancel()
+			}
+			vm.Pop(1)
+		}
+	}
+
+	if callErr != nil {
+		vm.RaiseError("graphql callback error: %v", callErr)
+		return 1
+	}
+	if err != nil {
+		vm.RaiseError("graphql error: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func graphql_schema(vm *lua.LState) int {
+	refresh := vm.OptBool(1, false)
+
+	ctx, ok := CheckGetContext(vm)
+	if !ok {
+		return 1
+	}
+	req, ok := CheckContextToHttpContext(vm, ctx, GetVars(vm))
+	if !ok {
+		return 1
+	}
+
+	schema := LoadGraphqlSchema(req.Url)
+	if schema == nil || refresh {
+		var err error
+		Unblock(func() { schema, err = IntrospectGraphqlSchema(req) })
+		if err != nil {
+			vm.RaiseError("graphql schema error: %v", err)
+			return 1
+		}
+	}
+	fmt.Print(schema)
+	return 0
+}
+
+// sendRpc 发送 json-rpc 请求，返回与 reqs 顺序一致的响应
+func sendRpc(vm *lua.LState, reqs []*RpcRequest, body interface{}, formatJson bool) []*RpcResponse {
+	ctx, ok := CheckGetContext(vm)
+	if !ok {
+		return nil
+	}
+	req, ok := CheckContextToHttpContext(vm, ctx, GetVars(vm))
+	if !ok {
+		return nil
+	}
+	httpCtx, err := NewRpcHttpContext(req, body)
+	if err != nil {
+		vm.RaiseError("rpc error: %v", err)
+		return nil
+	}
+
+	var resp *HttpResponse
+	Unblock(func() { resp, err = httpCtx.Send() })
+	if err != nil {
+		vm.RaiseError("rpc error: %v", err)
+		return nil
+	}
+	DefaultHistory.Add(httpCtx, resp)
+	PrintOutputBody(resp.Body, formatJson)
+
+	resps, err := ParseRpcResponses(resp.Body)
+	if err != nil {
+		vm.RaiseError("%v", err)
+		return nil
+	}
+	return MatchRpcResponses(reqs, resps)
+}
+
+func rpc(vm *lua.LState) int {
+	method := vm.CheckString(1)
+
+	var (
+		params     interface{}
+		formatJson bool
+		err        error
+	)
+	switch v := vm.Get(2).(type) {
+	case lua.LBool:
+		formatJson = bool(v)
+	case *lua.LNilType:
+	default:
+		if params, err = LValueToJsonValue(v); err != nil {
+			vm.ArgError(2, err.Error())
+			return 1
+		}
+		formatJson = vm.OptBool(3, false)
+	}
+
+	req := NewRpcRequest(method, params)
+	resps := sendRpc(vm, []*RpcRequest{req}, req, formatJson)
+	if resps[0].Error != nil {
+		vm.Error(resps[0].Error.ToLTable(vm), 1)
+		return 1
+	}
+	vm.Push(JsonToLValue(vm, resps[0].Result))
+	return 1
+}
+
+func rpc_batch(vm *lua.LState) int {
+	tab := vm.CheckTable(1)
+	formatJson := vm.OptBool(2, false)
+
+	reqs := make([]*RpcRequest, 0, tab.Len())
+	for i := 1; i <= tab.Len(); i++ {
+		item, ok := tab.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			vm.ArgError(1, fmt.Sprintf("item %d must be {method, params} or {method=, params=}", i))
+			return 1
+		}
+		method := GetLTableString(item, "method")
+		if s, ok := item.RawGetInt(1).(lua.LString); ok && method == "" {
+			method = string(s)
+		}
+		if method == "" {
+			vm.ArgError(1, fmt.Sprintf("item %d: method is required", i))
+			return 1
+		}
+		paramsValue := item.RawGetString("params")
+		if paramsValue == lua.LNil {
+			paramsValue = item.RawGetInt(2)
+		}
+		params, err := LValueToJsonValue(paramsValue)
+		if err != nil {
+			vm.ArgError(1, fmt.Sprintf("item %d: %v", i, err))
+			return 1
+		}
+		reqs = append(reqs, NewRpcRequest(method, params))
+	}
+	if len(reqs) == 0 {
+		vm.ArgError(1, "empty batch")
+		return 1
+	}
+
+	resps := sendRpc(vm, reqs, reqs, formatJson)
+	for _, resp := range resps {
+		if resp.Error != nil {
+			vm.Error((&RpcBatchError{Reqs: reqs, Resps: resps}).ToLTable(vm), 1)
+			return 1
+		}
+	}
+
+	results := vm.NewTable()
+	for i, resp := range resps {
+		results.RawSetInt(i+1, JsonToLValue(vm, resp.Result))
+	}
+	vm.Push(results)
+	return 1
+}
+
+func output(vm *lua.LState) int {
+	if vm.GetTop() > 0 {
+		if err := SetOutputMode(vm.CheckString(1)); err != nil {
+			vm.RaiseError("%v", err)
+			return 1
+		}
+	}
+	vm.Push(lua.LString(OutputMode()))
+	return 1
+}
+
 func help(vm *lua.LState) int {
-	fmt.Println(`=== context
+	fmt.Print(`=== context
 context = {
 	method = "GET",  # GET|PUT|POST|DELETE
 	url    = "",     # must string
 	data   = "",     # must string, if data is not empty, use data
-	query  = {},     # must table
-	header = {},     # must table
+	query  = {},     # must table, always appended to url, array value means repeated keys, e.g. {tag = {"a", "b"}}, order is preserved
+	header = {},     # must table, array value means multiple values, e.g. {["X-Tag"] = {"a", "b"}}
+	form   = nil,    # optional table, urlencoded body, used when data is empty
+	json   = nil,    # optional table, json body with header "Content-Type: application/json", used when data is empty
+	unix_socket = "",  # optional, send request through unix socket, or use url http+unix://%2Fvar%2Frun%2Fdocker.sock/path
+	resolve = {},      # optional, {"host:port:addr"}, connect to addr instead of resolving host, like curl --resolve
+	http_version = "", # optional, auto|1.1|2|h2c, 2 means HTTP/2 over tls or h2c over plain http, h2c means prior knowledge h2c
+	compressed = false,   # optional, send "Accept-Encoding: gzip, deflate, br, zstd" and decode the response
+	gzip_request = false, # optional, gzip request data with header "Content-Encoding: gzip"
+	retry = nil,          # optional, {attempts=3, backoff="exponential", base="200ms", max="30s", on={502,503,504,"timeout","connreset"}, respect_retry_after=true, allow_post=false}
 }
+vars = {},           # ${name} in url|data|query|header is replaced by vars.name when sending
 
 === functions
 exit|quit                 : exit
@@ -333,18 +1353,82 @@ reset()                   : reset context
 loadf(string)             : load lua file, absolute path
 load(string)              : load lua file, default in dir ~/.icurl/
 list()                    : list lua file, default in dir ~/.icurl/
-save(string, [bool])      : save lua file, default in dir ~/.icurl/, bool arg means whether overwrite existing file or not
+save(string, [bool])      : save context as lua file with sorted keys, default in dir ~/.icurl/, bool arg means whether overwrite existing file or not
 debug()                   : print context information
-send([bool])              : send requeset, method is context.method, bool arg means json pretty formatting
-send_get([bool])          : send get requeset, bool arg means json pretty formatting
-send_post([bool])         : send post requeset, bool arg means json pretty formatting
-send_form([bool])         : send post requeset, with header "Content-Type:application/x-www-form-urlencoded", bool arg means json pretty formatting
-send_lua(string, [bool])  : exec the lua file, bool arg means json pretty formatting
+send([string|table], [bool]): send requeset, method is context.method, bool arg means formatting body by Content-Type
+                            string|table arg means sending the named context or the table instead of context, also for send_get|send_post|send_form
+send_get([...])           : send get requeset, bool arg means formatting body by Content-Type
+send_post([...])          : send post requeset, bool arg means formatting body by Content-Type
+send_form([...])          : send post requeset, with header "Content-Type:application/x-www-form-urlencoded", body is context.form, context.query stays on url
+                            bool arg means formatting body by Content-Type
+send_lua(string, [bool])  : exec the lua file on a copy of context and send it, context is restored afterwards, bool arg means formatting body by Content-Type
+with_context(table|string, function): call function with a copy of context, fields of table replace those of the copy
+                            string arg means a copy of the named context, e.g. with_context("staging", function() return rpc("ping") end)
+                            context is restored afterwards even on error, return the results of function
+                            switching named context is not allowed inside function and send_lua files
+ctx_new(string, [table])  : create named context and switch to it, initialized like a new session or from the table arg
+ctx_use(string)           : switch to named context, the default context is named "default"
+ctx_list()                : list named contexts, the active one is marked with *
+ctx_copy(string, string)  : copy named context from the first arg to the second, overwrite if exists
 set_query(string, string) : set context.query
 set_header(string, string): set context.header
 json_encode(table, [bool]): json encode, bool arg means json pretty formatting
+json.null                 : json null, nil values are dropped from lua tables
+json.array([table])       : mark table as json array, json.array() is an empty array, {} is an empty object
+json.object([table])      : mark table as json object
+json.number(string)       : number encoded as is, for integers beyond 2^53, e.g. json.number("1234567890123456789")
 shell(string)             : exec shell command
 !string                   : exec shell command
+history([number])         : list request history, number arg means only show the last n entries
+history_persist([bool])   : persist request history into ~/.icurl/history.jsonl, false means stop persisting
+                            loaded entries are listed first and all entries are renumbered in list order
+last()                    : return the last response, {id, status, header, body, json, duration, request}
+                            header with multiple values, e.g. Set-Cookie, is an array
+resp(number)              : return the response of history entry n
+resend(number, [bool])    : resend the request of history entry n, bool arg means formatting body by Content-Type
+diff(number, number)      : show structural json diff of the responses of two history entries
+compare(string, string, [table]): send context to two envs concurrently and diff status|header|json body, arg is env name in ~/.icurl/env/ or base url, table arg means extra ignore rules, e.g. {"$.data[*].updated_at", "nonce"}
+bench([table])            : send context repeatedly, table arg is {n=1000, concurrency=20, duration="30s", rate=100, output="bench.csv|bench.json", context="name"|{}}, return the summary
+send_async([string|table]): send context in background, return a handle, string|table arg means the named context or the table instead of context
+wait(handle...)           : wait handles returned by send_async, return the responses with field handle, failed response is {id=handle, handle, status=0, error}
+wait_all()                : wait all pending handles, return table of responses
+batch(table)              : send contexts concurrently, table arg is {ctx1, ctx2, ..., concurrency=4}, return table of responses in order
+serve(table)              : start mock server, table arg is {host="127.0.0.1", port=8080, routes={["GET /users/:id"]=function(req) return {status=200, json={}} end}, mocks={"users"}}
+                            mocks are files in dir ~/.icurl/mocks/ which return routes table, "*" means all
+                            req is {method, path, params, query, header, body, json}, response is {status, header, json|body, delay} or string
+                            listens on 127.0.0.1 unless host is set, query and header with multiple values are arrays
+serve_stop([number])      : stop mock server on port, stop all if no port
+cassette(string, [table]) : record or replay requests with cassette file ~/.icurl/cassettes/<name>.json, table arg is {mode="auto|record|replay", match={"method","url","body","header:X-Name"}, redact={"X-Secret"}}
+                            redact is added to the default list, Authorization, Cookie, token, etc., redact_defaults=false means only redact the given list
+cassette_stop()           : stop recording or replaying
+proxy([table])            : start capture proxy, table arg is {listen="127.0.0.1:8888", mitm=true}, requests through proxy are saved into history
+                            https is decrypted with CA ~/.icurl/proxy/ca.pem, which needs to be trusted by the client
+proxy_stop()              : stop capture proxy
+use(number)               : set context from the request of history entry n
+sse([function|table])     : receive server-sent events from context, print events as they arrive, Ctrl-C to stop
+                            function arg is called with {id, event, data, retry, json} for each event, return false to stop
+                            table arg is {callback=function, reconnect=true, context="name"|{}}, reconnect with Last-Event-ID by default
+stream([function])        : print streaming response line by line as it arrives, function arg is called with each line, return false to stop
+ws([string], [table])     : connect websocket and enter ws> prompt, lines are sent as text frames, received frames are printed as they arrive
+                            url defaults to context.url with context.header, table arg is {headers={}, subprotocols={}, on_message=function(msg)}
+                            msg is {type="text|binary|ping|pong|close", data, code, json}, return false to close
+                            commands in ws> prompt: /ping [data], /binary <hex>, /text <string>, /close [code] [reason], Ctrl-C to quit
+ws_connect([string], [table]): connect websocket for scripting, return conn with methods send(string), send_binary(string), ping([string]),
+                            recv([duration]) return msg or nil on timeout|close, close([code], [reason]), table arg is the same as ws()
+grpc(table, [bool])       : call grpc method, print status, metadata and response as json, bool arg means json pretty formatting
+                            table arg is {target="host:port", method="pkg.Service/Method", message={}, metadata={}, proto={"api.proto"}, import_paths={}, tls=false, insecure=false, timeout="10s"}
+                            target defaults to host of context.url, schema is resolved via server reflection if proto is not set
+                            return {code, message, header, trailer, body, json, duration}
+graphql(table, [bool])    : send graphql request to context.url, print data and errors separately, bool arg means json pretty formatting
+                            table arg is {query=[[...]], variables={}, operation="", callback=function, context="name"|{}}, return {status, data, errors, body}
+                            subscription is sent over websocket (graphql-transport-ws or graphql-ws), callback is called with {data, errors}, return false to stop
+graphql_schema([bool])    : print schema of context.url by introspection, cached in dir ~/.icurl/graphql/ and used by <Tab> completion, bool arg means refresh
+rpc(string, [table], [bool]): send json-rpc 2.0 request to context.url, return the result, error is raised as table {code=, message=, data=}
+                            table arg is params, array or object, bool arg means json pretty formatting
+rpc_batch(table, [bool])  : send json-rpc batch request, table arg is {{"method", params}, {method="", params={}}, ...}
+                            return results in order, raise table {message=, errors={{index=, method=, code=, message=, data=}, ...}} listing all failed calls
+output([string])          : get or set output mode of send, default|silent|include|head|verbose, like curl -s|-i|-I|-v
+import_postman(string, [bool]): import postman v2.1 collection or environment into dir ~/.icurl/, bool arg means whether overwrite existing file or not
 help()                    : show this help information
 
 Everything follows Lua grammar.
@@ -1,7 +1,11 @@
 package lualib
 
 import (
+	"bufio"
+	"fmt"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/yuin/gopher-lua"
 )
@@ -10,6 +14,8 @@ const (
 	INIT_ENV_NAME  = "ICURL_PATH"
 	INIT_HOME_PATH = "~/.icurl"
 	INIT_LUA_FILE  = "init.lua"
+	ENV_DIR        = "env"
+	INIT_VARS_CODE = `vars = {}`
 	INIT_CODE      = `
 context = {
 	method = "GET",
@@ -34,7 +40,42 @@ setmetatable(_G, {
 `
 )
 
+var (
+	// lua 虚拟机锁，只有持有锁的 goroutine 可以使用虚拟机
+	// 主 goroutine 执行 lua 代码时持有锁，等待输入和发送请求时释放，mock server 的 handler 获取锁后执行
+	vmLock sync.Mutex
+
+	// Prompter 读取一行输入，用于 ws 等子交互模式，交互式终端中由 main 替换为 liner
+	Prompter = func(prompt string) (string, error) {
+		fmt.Print(prompt)
+		line, err := stdinReader.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	stdinReader = bufio.NewReader(os.Stdin)
+)
+
+func LockVM() {
+	vmLock.Lock()
+}
+
+func UnlockVM() {
+	vmLock.Unlock()
+}
+
+// Unblock 在持有锁的 goroutine 中执行阻塞操作，执行期间释放锁
+func Unblock(fn func()) {
+	vmLock.Unlock()
+	defer vmLock.Lock()
+	fn()
+}
+
 func Init(vm *lua.LState) error {
+	if err := RunLuaCode(vm, INIT_VARS_CODE); err != nil {
+		return err
+	}
 	if err := InitContext(vm); err != nil {
 		return err
 	}
@@ -72,6 +113,89 @@ func CheckGetContext(vm *lua.LState) (*lua.LTable, bool) {
 	return ctx, true
 }
 
+// GetVars 获取全局变量表 vars，用于 ${var} 替换
+func GetVars(vm *lua.LState) map[string]string {
+	vars, _ := vm.GetGlobal("vars").(*lua.LTable)
+	return LTableToMapString(vars)
+}
+
+// ContextToHttpContext 根据 context table 构造请求，并替换其中的 ${var}
+func ContextToHttpContext(ctx *lua.LTable, vars map[string]string) (*HttpContext, error) {
+	httpCtx := NewHttpContext()
+	httpCtx.Method = GetLTableString(ctx, "method", "GET")
+	httpCtx.Url = ExpandVars(GetLTableString(ctx, "url", ""), vars)
+	httpCtx.Data = ExpandVars(GetLTableString(ctx, "data", ""), vars)
+	httpCtx.Query = LTableToParams(GetLTableTable(ctx, "query")).Expand(vars)
+	httpCtx.Header = LTableToParams(GetLTableTable(ctx, "header")).Expand(vars)
+	if t := GetLTableTable(ctx, "form"); t != nil {
+		httpCtx.Form = LTableToParams(t).Expand(vars)
+	}
+	if v := ctx.RawGetString("json"); v != lua.LNil {
+		body, err := LValueToJsonBody(v, vars)
+		if err != nil {
+			return nil, fmt.Errorf("invalid context.json: %v", err)
+		}
+		httpCtx.Json = body
+	}
+	httpCtx.UnixSocket = ExpandVars(GetLTableString(ctx, "unix_socket"), vars)
+	if socket, u, ok := SplitUnixUrl(httpCtx.Url); ok {
+		httpCtx.UnixSocket, httpCtx.Url = socket, u
+	}
+	resolve, err := LTableToResolve(GetLTableTable(ctx, "resolve"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid context.resolve: %v", err)
+	}
+	httpCtx.Resolve = resolve
+	httpCtx.HttpVersion = GetLTableString(ctx, "http_version")
+	httpCtx.Compressed = ctx.RawGetString("compressed") == lua.LTrue
+	httpCtx.GzipRequest = ctx.RawGetString("gzip_request") == lua.LTrue
+	if t := GetLTableTable(ctx, "retry"); t != nil {
+		retry, err := LTableToRetryPolicy(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid context.retry: %v", err)
+		}
+		httpCtx.Retry = retry
+	}
+	return httpCtx, nil
+}
+
+// CheckContextToHttpContext 同 ContextToHttpContext，context 中有无效的字段时抛出错误
+func CheckContextToHttpContext(vm *lua.LState, ctx *lua.LTable, vars map[string]string) (*HttpContext, bool) {
+	httpCtx, err := ContextToHttpContext(ctx, vars)
+	if err != nil {
+		vm.RaiseError("%v", err)
+		return nil, false
+	}
+	return httpCtx, true
+}
+
+// LTableToResolve 解析 {"host:port:addr"} 或 {["host:port"] = "addr"}，有无效的条目时返回错误
+func LTableToResolve(table *lua.LTable) (map[string]string, error) {
+	if table == nil {
+		return nil, nil
+	}
+	entries := make([]string, 0)
+	table.ForEach(func(k, v lua.LValue) {
+		if _, ok := k.(lua.LNumber); ok {
+			entries = append(entries, v.String())
+		} else {
+			entries = append(entries, k.String()+":"+v.String())
+		}
+	})
+
+	res := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		m, err := ParseResolve([]string{entry})
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range m {
+			res[k] = v
+		}
+	}
+	return res, nil
+}
+
 func GetLTableString(table *lua.LTable, field string, defval ...string) string {
 	v, ok := table.RawGetString(field).(lua.LString)
 	if ok {
@@ -117,14 +241,38 @@ func RunLuaFile(vm *lua.LState, fpath string) error {
 	if !FileExists(fpath) {
 		return nil
 	}
-	return vm.DoFile(fpath)
+	return luaError(vm, vm.DoFile(fpath))
 }
 
 func RunLuaCode(vm *lua.LState, code string) error {
 	if code == "" {
 		return nil
 	}
-	return vm.DoString(code)
+	return luaError(vm, vm.DoString(code))
+}
+
+// setErrorString 设置 __tostring，作为错误抛出的 table 输出为 s
+func setErrorString(vm *lua.LState, t *lua.LTable, s string) {
+	mt := vm.NewTable()
+	mt.RawSetString("__tostring", vm.NewFunction(func(vm *lua.LState) int {
+		vm.Push(lua.LString(s))
+		return 1
+	}))
+	vm.SetMetatable(t, mt)
+}
+
+// luaError 错误对象是带有 __tostring 的 table 时，使用 __tostring 的结果作为错误信息
+func luaError(vm *lua.LState, err error) error {
+	apiErr, ok := err.(*lua.ApiError)
+	if !ok || apiErr.Object == nil {
+		return err
+	}
+	if _, ok := apiErr.Object.(*lua.LTable); !ok || vm.GetMetaField(apiErr.Object, "__tostring") == lua.LNil {
+		return err
+	}
+	res := *apiErr
+	res.Object = lua.LString(vm.ToStringMeta(apiErr.Object).String())
+	return &res
 }
 
 func CallLuaFunc(vm *lua.LState, fn string, nret int, args ...lua.LValue) ([]lua.LValue, error) {
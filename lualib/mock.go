@@ -0,0 +1,356 @@
+package lualib
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	MOCK_DIR          = "mocks"
+	MOCK_DEFAULT_HOST = "127.0.0.1" // 默认只监听本机，handler 在持有虚拟机锁时执行用户的 lua 代码
+)
+
+var (
+	mockServers   = make(map[int]*MockServer)
+	mockServersMu sync.Mutex
+)
+
+// MockRoute 路由，key 形如 "GET /users/:id"，省略 method 时匹配任意 method
+// :name 匹配一段路径，* 匹配剩余路径
+type MockRoute struct {
+	Key      string
+	Method   string
+	Segments []string
+	Handler  lua.LValue // function(req) 或者 table
+}
+
+type MockResponse struct {
+	Status int
+	Header Params
+	Body   string
+	Delay  time.Duration
+}
+
+// MockServer 由 lua 驱动的 http server，handler 获取虚拟机锁后在同一个 lua 虚拟机中执行
+type MockServer struct {
+	Host   string
+	Port   int
+	vm     *lua.LState
+	routes []*MockRoute
+	server *http.Server
+}
+
+func NewMockRoute(key string, handler lua.LValue) (*MockRoute, error) {
+	fields := strings.Fields(key)
+	route := &MockRoute{Key: key, Handler: handler}
+	switch len(fields) {
+	case 1:
+		route.Segments = splitPath(fields[0])
+	case 2:
+		route.Method = strings.ToUpper(fields[0])
+		route.Segments = splitPath(fields[1])
+	default:
+		return nil, fmt.Errorf("invalid route %s, need \"METHOD /path\"", key)
+	}
+
+	switch handler.Type() {
+	case lua.LTFunction, lua.LTTable:
+	default:
+		return nil, fmt.Errorf("route %s handler must be function or table", key)
+	}
+	return route, nil
+}
+
+func (route *MockRoute) Match(method string, segments []string) (map[string]string, bool) {
+	if route.Method != "" && route.Method != method {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for i, seg := range route.Segments {
+		if seg == "*" {
+			params["*"] = strings.Join(segments[i:], "/")
+			return params, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		if strings.HasPrefix(seg, ":") {
+			params[seg[1:]] = segments[i]
+		} else if seg != segments[i] {
+			return nil, false
+		}
+	}
+	return params, len(route.Segments) == len(segments)
+}
+
+// LTableToMockRoutes 解析路由表，静态路径优先于参数，参数优先于通配符
+func LTableToMockRoutes(table *lua.LTable) ([]*MockRoute, error) {
+	routes := make([]*MockRoute, 0)
+
+	var err error
+	table.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		var route *MockRoute
+		if route, err = NewMockRoute(k.String(), v); err == nil {
+			routes = append(routes, route)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		ri, rj := routes[i].weight(), routes[j].weight()
+		if ri != rj {
+			return ri > rj
+		}
+		return routes[i].Key < routes[j].Key
+	})
+	return routes, nil
+}
+
+func (route *MockRoute) weight() int {
+	weight := 0
+	for _, seg := range route.Segments {
+		weight *= 4
+		switch {
+		case seg == "*":
+		case strings.HasPrefix(seg, ":"):
+			weight += 1
+		default:
+			weight += 2
+		}
+	}
+	if route.Method != "" {
+		weight = weight*2 + 1
+	}
+	return weight
+}
+
+// LoadMockRoutes 加载 ~/.icurl/mocks/ 下的路由文件，文件需要 return 路由表，name 为 * 时加载全部
+func LoadMockRoutes(vm *lua.LState, names []string) (*lua.LTable, error) {
+	dir := GetRealPath(GetBasePath() + "/" + MOCK_DIR)
+
+	files := make([]string, 0)
+	for _, name := range names {
+		if name == "*" {
+			for _, f := range ListDir(dir) {
+				if strings.HasSuffix(f, ".lua") {
+					files = append(files, filepath.Join(dir, f))
+				}
+			}
+			continue
+		}
+		if !strings.HasSuffix(name, ".lua") {
+			name += ".lua"
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+
+	routes := vm.NewTable()
+	for _, fpath := range files {
+		fn, err := vm.LoadFile(fpath)
+		if err != nil {
+			return nil, err
+		}
+		vm.Push(fn)
+		if err := vm.PCall(0, 1, nil); err != nil {
+			return nil, err
+		}
+		ret := vm.Get(-1)
+		vm.Pop(1)
+
+		table, ok := ret.(*lua.LTable)
+		if !ok {
+			return nil, fmt.Errorf("%s must return routes table", fpath)
+		}
+		table.ForEach(func(k, v lua.LValue) {
+			routes.RawSet(k, v)
+		})
+	}
+	return routes, nil
+}
+
+// StartMockServer 在 host:port 上启动 mock server，host 为空时只监听 127.0.0.1，同一端口重复启动时替换原有的 server
+func StartMockServer(vm *lua.LState, host string, port int, routes []*MockRoute) (*MockServer, error) {
+	StopMockServer(port)
+
+	if host == "" {
+		host = MOCK_DEFAULT_HOST
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &MockServer{
+		Host:   host,
+		Port:   ln.Addr().(*net.TCPAddr).Port,
+		vm:     vm,
+		routes: routes,
+	}
+	s.server = &http.Server{Handler: s}
+	go s.server.Serve(ln)
+
+	mockServersMu.Lock()
+	mockServers[s.Port] = s
+	mockServersMu.Unlock()
+	return s, nil
+}
+
+// StopMockServer 停止 mock server，port 为 0 时停止全部
+func StopMockServer(port int) []int {
+	mockServersMu.Lock()
+	servers := make([]*MockServer, 0)
+	for p, s := range mockServers {
+		if port == 0 || p == port {
+			servers = append(servers, s)
+			delete(mockServers, p)
+		}
+	}
+	mockServersMu.Unlock()
+
+	ports := make([]int, 0, len(servers))
+	for _, s := range servers {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		s.server.Shutdown(ctx)
+		cancel()
+		ports = append(ports, s.Port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+func (s *MockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	resp := s.handle(r, string(body))
+	if resp.Delay > 0 {
+		time.Sleep(resp.Delay)
+	}
+
+	resp.Header.ApplyHeader(w.Header())
+	w.WriteHeader(resp.Status)
+	w.Write([]byte(resp.Body))
+
+	Diagf("[mock :%d] %s %s => %d (%s)\n", s.Port, r.Method, r.URL.RequestURI(), resp.Status, time.Since(start).Round(time.Microsecond))
+}
+
+func (s *MockServer) handle(r *http.Request, body string) *MockResponse {
+	method := strings.ToUpper(r.Method)
+	segments := splitPath(r.URL.Path)
+
+	for _, route := range s.routes {
+		params, ok := route.Match(method, segments)
+		if !ok {
+			continue
+		}
+
+		LockVM()
+		defer UnlockVM()
+
+		resp, err := s.call(route, r, body, params)
+		if err != nil {
+			return &MockResponse{
+				Status: http.StatusInternalServerError,
+				Header: Params{{Key: "Content-Type", Value: "text/plain; charset=utf-8"}},
+				Body:   fmt.Sprintf("mock route %s error: %v", route.Key, err),
+			}
+		}
+		return resp
+	}
+
+	return &MockResponse{
+		Status: http.StatusNotFound,
+		Header: Params{{Key: "Content-Type", Value: "application/json"}},
+		Body:   `{"error":"no mock route"}`,
+	}
+}
+
+func (s *MockServer) call(route *MockRoute, r *http.Request, body string, params map[string]string) (*MockResponse, error) {
+	vm := s.vm
+
+	ret := route.Handler
+	if fn, ok := ret.(*lua.LFunction); ok {
+		// 多个值的 query 和 header 转换为数组
+		req := vm.NewTable()
+		SetLTableString(req, "method", r.Method)
+		SetLTableString(req, "path", r.URL.Path)
+		SetLTable(req, "params", MapStringToLTable(vm, params))
+		SetLTable(req, "query", ParamsToLTable(vm, ParseQueryParams(r.URL.RawQuery)))
+		SetLTable(req, "header", ParamsToLTable(vm, HeaderToParams(r.Header)))
+		SetLTableString(req, "body", body)
+		if v, ok := ParseJson(body); ok {
+			SetLTable(req, "json", JsonToLValue(vm, v))
+		}
+
+		if err := vm.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, req); err != nil {
+			return nil, err
+		}
+		ret = vm.Get(-1)
+		vm.Pop(1)
+	}
+
+	return LValueToMockResponse(ret)
+}
+
+// LValueToMockResponse 解析 handler 返回值 {status=200, header={}, json={} | body="", delay="100ms"}
+// 返回字符串时作为 body，header 的数组值输出为多个同名 header
+func LValueToMockResponse(ret lua.LValue) (*MockResponse, error) {
+	resp := &MockResponse{Status: http.StatusOK, Header: make(Params, 0)}
+
+	switch ret := ret.(type) {
+	case lua.LString:
+		resp.Body = string(ret)
+	case *lua.LTable:
+		resp.Status = GetLTableInt(ret, "status", http.StatusOK)
+		resp.Header = LTableToParams(GetLTableTable(ret, "header"))
+		resp.Body = GetLTableString(ret, "body")
+		if js := GetLTableTable(ret, "json"); js != nil {
+			s, err := LTableToJsonString(js, false)
+			if err != nil {
+				return nil, err
+			}
+			resp.Body = s
+			if !resp.Header.HasFold("Content-Type") {
+				resp.Header.Add("Content-Type", "application/json")
+			}
+		}
+		if d := GetLTableString(ret, "delay"); d != "" {
+			delay, err := time.ParseDuration(d)
+			if err != nil {
+				return nil, err
+			}
+			resp.Delay = delay
+		}
+	case *lua.LNilType:
+	default:
+		return nil, fmt.Errorf("handler must return table or string, got %s", ret.Type())
+	}
+	return resp, nil
+}
+
+func splitPath(path string) []string {
+	segments := make([]string, 0)
+	for _, seg := range strings.Split(path, "/") {
+		if seg != "" {
+			segments = append(segments, seg)
+		}
+	}
+	return segments
+}
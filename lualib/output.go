@@ -0,0 +1,121 @@
+package lualib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	OUTPUT_DEFAULT = "default" // 诊断信息和响应头输出到 stderr，body 输出到 stdout
+	OUTPUT_SILENT  = "silent"  // 只输出 body，类似 curl -s
+	OUTPUT_INCLUDE = "include" // stdout 先输出状态行和响应头，再输出 body，类似 curl -i
+	OUTPUT_HEAD    = "head"    // stdout 只输出状态行和响应头，类似 curl -I
+	OUTPUT_VERBOSE = "verbose" // stderr 额外输出请求行和请求头，类似 curl -v
+)
+
+var (
+	outputMode = OUTPUT_DEFAULT
+)
+
+// SetOutputMode 设置 HttpContext.Send 的输出模式，空字符串等同于 default
+func SetOutputMode(mode string) error {
+	if mode == "" {
+		mode = OUTPUT_DEFAULT
+	}
+	switch mode {
+	case OUTPUT_DEFAULT, OUTPUT_SILENT, OUTPUT_INCLUDE, OUTPUT_HEAD, OUTPUT_VERBOSE:
+		outputMode = mode
+		return nil
+	}
+	return fmt.Errorf("invalid output mode %s, need default|silent|include|head|verbose", mode)
+}
+
+func OutputMode() string {
+	return outputMode
+}
+
+// Diagf 输出诊断信息到 stderr，silent 模式下不输出
+func Diagf(format string, a ...interface{}) {
+	if outputMode != OUTPUT_SILENT {
+		fmt.Fprintf(os.Stderr, format, a...)
+	}
+}
+
+// PrintOutputBody 输出 grpc、graphql、json-rpc 等的响应 body，head 模式下不输出
+func PrintOutputBody(body string, formatJson bool) {
+	if outputMode != OUTPUT_HEAD {
+		PrintBody(body, formatJson)
+	}
+}
+
+// printRequest verbose 模式下输出实际发送的请求行和请求头，回放的响应没有请求时使用 context
+func printRequest(ctx *HttpContext, req *http.Request) {
+	if req == nil {
+		req, _ = ctx.NewRequest(context.Background())
+		if req == nil {
+			return
+		}
+	}
+	uri := req.URL.RequestURI()
+	fmt.Fprintf(os.Stderr, "> %s %s %s\n", req.Method, uri, req.Proto)
+	fmt.Fprintf(os.Stderr, "> Host: %s\n", req.URL.Host)
+	printHeader("> ", req.Header, true)
+	if body, _ := ctx.Body(); body != "" && req.Method != "GET" {
+		fmt.Fprintf(os.Stderr, "> [%d bytes data]\n", len(body))
+	}
+	fmt.Fprintln(os.Stderr, ">")
+}
+
+func sortedHeaderKeys(header http.Header) []string {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func printHeader(prefix string, header http.Header, stderr bool) {
+	out := os.Stdout
+	if stderr {
+		out = os.Stderr
+	}
+	for _, k := range sortedHeaderKeys(header) {
+		for _, v := range header[k] {
+			fmt.Fprintf(out, "%s%s: %s\n", prefix, k, v)
+		}
+	}
+}
+
+// printResponseHead 按输出模式输出状态行和响应头
+func printResponseHead(resp *HttpResponse) {
+	proto := resp.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	status := strings.TrimSpace(fmt.Sprintf("%s %d %s", proto, resp.StatusCode, http.StatusText(resp.StatusCode)))
+
+	switch outputMode {
+	case OUTPUT_SILENT:
+	case OUTPUT_INCLUDE, OUTPUT_HEAD:
+		fmt.Println(status)
+		printHeader("", resp.Header, false)
+		fmt.Println()
+	case OUTPUT_VERBOSE:
+		fmt.Fprintf(os.Stderr, "< %s\n", status)
+		printHeader("< ", resp.Header, true)
+		fmt.Fprintln(os.Stderr, "<")
+	default:
+		fmt.Fprintf(os.Stderr, "=== Response header\n")
+		for _, k := range sortedHeaderKeys(resp.Header) {
+			for _, v := range resp.Header[k] {
+				fmt.Fprintf(os.Stderr, "%s = %s\n", k, v)
+			}
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+}
@@ -0,0 +1,304 @@
+package lualib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+type Param struct {
+	Key   string
+	Value string
+}
+
+// Params 有序的多值参数，用于 query 和 header，同一个 key 可以出现多次
+type Params []Param
+
+// Get 返回 key 的第一个值
+func (ps Params) Get(key string) string {
+	for _, p := range ps {
+		if p.Key == key {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+func (ps Params) Values(key string) []string {
+	res := make([]string, 0)
+	for _, p := range ps {
+		if p.Key == key {
+			res = append(res, p.Value)
+		}
+	}
+	return res
+}
+
+func (ps Params) Has(key string) bool {
+	for _, p := range ps {
+		if p.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFold 忽略大小写判断 key 是否存在，用于 header
+func (ps Params) HasFold(key string) bool {
+	for _, p := range ps {
+		if strings.EqualFold(p.Key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ps *Params) Add(key, value string) {
+	*ps = append(*ps, Param{Key: key, Value: value})
+}
+
+// Set 替换 key 的所有值，保留第一个值的位置，不存在时追加到末尾
+func (ps *Params) Set(key, value string) {
+	ps.set(key, value, func(k string) bool { return k == key })
+}
+
+// SetFold 忽略大小写替换 key 的所有值，用于 header
+func (ps *Params) SetFold(key, value string) {
+	ps.set(key, value, func(k string) bool { return strings.EqualFold(k, key) })
+}
+
+func (ps *Params) set(key, value string, match func(string) bool) {
+	res := (*ps)[:0]
+	found := false
+	for _, p := range *ps {
+		if !match(p.Key) {
+			res = append(res, p)
+		} else if !found {
+			res = append(res, Param{Key: key, Value: value})
+			found = true
+		}
+	}
+	if !found {
+		res = append(res, Param{Key: key, Value: value})
+	}
+	*ps = res
+}
+
+func (ps *Params) Del(key string) {
+	res := (*ps)[:0]
+	for _, p := range *ps {
+		if p.Key != key {
+			res = append(res, p)
+		}
+	}
+	*ps = res
+}
+
+func (ps Params) Clone() Params {
+	if ps == nil {
+		return nil
+	}
+	res := make(Params, len(ps))
+	copy(res, ps)
+	return res
+}
+
+// Keys 按第一次出现的顺序返回不重复的 key
+func (ps Params) Keys() []string {
+	keys := make([]string, 0, len(ps))
+	seen := make(map[string]bool, len(ps))
+	for _, p := range ps {
+		if !seen[p.Key] {
+			seen[p.Key] = true
+			keys = append(keys, p.Key)
+		}
+	}
+	return keys
+}
+
+// Encode 按顺序编码为 url query，不像 url.Values.Encode 按 key 排序
+func (ps Params) Encode() string {
+	parts := make([]string, 0, len(ps))
+	for _, p := range ps {
+		parts = append(parts, url.QueryEscape(p.Key)+"="+url.QueryEscape(p.Value))
+	}
+	return strings.Join(parts, "&")
+}
+
+// ApplyHeader 添加到 http header，同一个 key 的多个值都保留
+func (ps Params) ApplyHeader(header http.Header) {
+	for _, key := range ps.Keys() {
+		header.Del(key)
+	}
+	for _, p := range ps {
+		header.Add(p.Key, p.Value)
+	}
+}
+
+func (ps Params) Expand(vars map[string]string) Params {
+	for i := range ps {
+		ps[i].Value = ExpandVars(ps[i].Value, vars)
+	}
+	return ps
+}
+
+// MarshalJSON 编码为有序的 json 对象，多个值的 key 编码为数组，与旧的 map[string]string 格式兼容
+func (ps Params) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range ps.Keys() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+
+		var (
+			v   []byte
+			err error
+		)
+		if values := ps.Values(key); len(values) == 1 {
+			v, err = json.Marshal(values[0])
+		} else {
+			v, err = json.Marshal(values)
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (ps *Params) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		*ps = nil
+		return nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return fmt.Errorf("params must be json object")
+	}
+
+	res := make(Params, 0)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		var values []string
+		if err := json.Unmarshal(raw, &values); err != nil {
+			var value string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return fmt.Errorf("param %s must be string or string array", key)
+			}
+			values = []string{value}
+		}
+		for _, v := range values {
+			res.Add(key, v)
+		}
+	}
+	*ps = res
+	return nil
+}
+
+// LTableToParams 按插入顺序转换 lua table，数组值转换为多个同名参数
+// 也支持 {{"key", "value"}, ...} 形式，用于完全控制顺序
+func LTableToParams(table *lua.LTable) Params {
+	res := make(Params, 0)
+	if table == nil {
+		return res
+	}
+	ForEachOrdered(table, func(k, v lua.LValue) {
+		if _, ok := k.(lua.LNumber); ok {
+			if pair, ok := v.(*lua.LTable); ok && pair.MaxN() == 2 {
+				res.Add(pair.RawGetInt(1).String(), pair.RawGetInt(2).String())
+			}
+			return
+		}
+		if arr, ok := v.(*lua.LTable); ok {
+			for i := 1; i <= arr.MaxN(); i++ {
+				res.Add(k.String(), arr.RawGetInt(i).String())
+			}
+			return
+		}
+		res.Add(k.String(), v.String())
+	})
+	return res
+}
+
+// ParseQueryParams 按原有顺序解析 url query，无法解码的部分保持原样
+func ParseQueryParams(raw string) Params {
+	res := make(Params, 0)
+	for _, pair := range strings.Split(raw, "&") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		res.Add(queryUnescape(kv[0]), queryUnescape(kv[1]))
+	}
+	return res
+}
+
+func queryUnescape(s string) string {
+	if u, err := url.QueryUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
+
+// HeaderToParams 按 key 排序转换 http header，同一个 key 的多个值都保留
+func HeaderToParams(header http.Header) Params {
+	res := make(Params, 0, len(header))
+	for _, k := range sortedHeaderKeys(header) {
+		for _, v := range header[k] {
+			res.Add(k, v)
+		}
+	}
+	return res
+}
+
+// ParamsToLTable 转换为 lua table，多个值的 key 转换为数组
+func ParamsToLTable(vm *lua.LState, ps Params) *lua.LTable {
+	table := vm.NewTable()
+	for _, key := range ps.Keys() {
+		values := ps.Values(key)
+		if len(values) == 1 {
+			SetLTableString(table, key, values[0])
+			continue
+		}
+		arr := vm.NewTable()
+		for _, v := range values {
+			arr.Append(lua.LString(v))
+		}
+		SetLTable(table, key, arr)
+	}
+	return table
+}
+
+// ForEachOrdered 按插入顺序遍历 table，LTable.ForEach 遍历 hash 部分时顺序是随机的
+func ForEachOrdered(table *lua.LTable, cb func(k, v lua.LValue)) {
+	for k, v := table.Next(lua.LNil); k != lua.LNil; k, v = table.Next(k) {
+		cb(k, v)
+	}
+}
@@ -0,0 +1,367 @@
+package lualib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	postmanVarRegexp  = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.\-]+)\s*\}\}`)
+	postmanNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_.\-]+`)
+)
+
+type PostmanKeyValue struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Disabled bool   `json:"disabled"`
+	Enabled  *bool  `json:"enabled"` // environment values use enabled instead of disabled
+}
+
+func (kv PostmanKeyValue) active() bool {
+	if kv.Disabled {
+		return false
+	}
+	return kv.Enabled == nil || *kv.Enabled
+}
+
+type PostmanUrl struct {
+	Raw   string            `json:"raw"`
+	Query []PostmanKeyValue `json:"query"`
+}
+
+type PostmanBody struct {
+	Mode       string            `json:"mode"` // raw|urlencoded|formdata
+	Raw        string            `json:"raw"`
+	Urlencoded []PostmanKeyValue `json:"urlencoded"`
+	Formdata   []PostmanKeyValue `json:"formdata"`
+}
+
+type PostmanRequest struct {
+	Method string            `json:"method"`
+	Header []PostmanKeyValue `json:"header"`
+	Url    json.RawMessage   `json:"url"` // string or PostmanUrl
+	Body   *PostmanBody      `json:"body"`
+}
+
+type PostmanEvent struct {
+	Listen string `json:"listen"` // prerequest|test
+	Script struct {
+		Exec json.RawMessage `json:"exec"` // string or []string
+	} `json:"script"`
+}
+
+type PostmanItem struct {
+	Name    string          `json:"name"`
+	Item    []PostmanItem   `json:"item"` // folder
+	Request *PostmanRequest `json:"request"`
+	Event   []PostmanEvent  `json:"event"`
+}
+
+type PostmanCollection struct {
+	Info struct {
+		Name string `json:"name"`
+	} `json:"info"`
+	Item     []PostmanItem     `json:"item"`
+	Event    []PostmanEvent    `json:"event"`
+	Variable []PostmanKeyValue `json:"variable"`
+}
+
+type PostmanEnvironment struct {
+	Name   string            `json:"name"`
+	Values []PostmanKeyValue `json:"values"`
+}
+
+// ImportPostman 导入 Postman v2.1 collection 或 environment 文件，返回生成的文件列表
+func ImportPostman(fpath string, overwrite bool) ([]string, error) {
+	content, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var probe struct {
+		Info   json.RawMessage `json:"info"`
+		Values json.RawMessage `json:"values"`
+	}
+	if err := json.Unmarshal(content, &probe); err != nil {
+		return nil, err
+	}
+
+	imp := &postmanImporter{
+		basePath:  GetRealPath(GetBasePath()),
+		overwrite: overwrite,
+		files:     make([]string, 0),
+	}
+
+	if probe.Info != nil {
+		var coll PostmanCollection
+		if err := json.Unmarshal(content, &coll); err != nil {
+			return nil, err
+		}
+		err = imp.importCollection(&coll)
+	} else if probe.Values != nil {
+		var env PostmanEnvironment
+		if err := json.Unmarshal(content, &env); err != nil {
+			return nil, err
+		}
+		err = imp.importEnvironment(env.Name, env.Values)
+	} else {
+		err = errors.New("unknown postman file, need v2.1 collection or environment")
+	}
+	return imp.files, err
+}
+
+// TranslatePostmanVars 将 {{var}} 转换为 ${var}
+func TranslatePostmanVars(s string) string {
+	return postmanVarRegexp.ReplaceAllString(s, "$${$1}")
+}
+
+type postmanImporter struct {
+	basePath  string
+	overwrite bool
+	files     []string
+	used      map[string]bool // 已经使用的文件路径，同一个目录下同名的请求加上 _2、_3 后缀
+}
+
+func (imp *postmanImporter) importCollection(coll *PostmanCollection) error {
+	collName := postmanFileName(coll.Info.Name, "collection")
+
+	if len(coll.Variable) > 0 {
+		if err := imp.importEnvironment(collName, coll.Variable); err != nil {
+			return err
+		}
+	}
+	return imp.importItems(filepath.Join(imp.basePath, collName), coll.Item, coll.Event)
+}
+
+func (imp *postmanImporter) importItems(dir string, items []PostmanItem, events []PostmanEvent) error {
+	for _, item := range items {
+		name := postmanFileName(item.Name, "item")
+		// 父级 folder 的脚本同样作用于子请求
+		itemEvents := append(append([]PostmanEvent{}, events...), item.Event...)
+
+		if item.Request == nil {
+			if err := imp.importItems(filepath.Join(dir, name), item.Item, itemEvents); err != nil {
+				return err
+			}
+			continue
+		}
+
+		code, err := postmanRequestToLuaCode(item, itemEvents)
+		if err != nil {
+			return fmt.Errorf("%s: %v", item.Name, err)
+		}
+		if err := imp.writeFile(imp.uniquePath(dir, name), code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (imp *postmanImporter) uniquePath(dir, name string) string {
+	if imp.used == nil {
+		imp.used = make(map[string]bool)
+	}
+	fpath := filepath.Join(dir, name+".lua")
+	for i := 2; imp.used[fpath]; i++ {
+		fpath = filepath.Join(dir, fmt.Sprintf("%s_%d.lua", name, i))
+	}
+	imp.used[fpath] = true
+	return fpath
+}
+
+func (imp *postmanImporter) importEnvironment(name string, values []PostmanKeyValue) error {
+	vars := make(map[string]interface{})
+	for _, kv := range values {
+		if kv.active() {
+			vars[kv.Key] = TranslatePostmanVars(kv.Value)
+		}
+	}
+
+	code, err := ToLuaCode(vars)
+	if err != nil {
+		return err
+	}
+
+	fpath := filepath.Join(imp.basePath, ENV_DIR, postmanFileName(name, "env")+".lua")
+	return imp.writeFile(fpath, fmt.Sprintf("-- imported from postman environment \"%s\"\nvars = %s\n", name, code))
+}
+
+func (imp *postmanImporter) writeFile(fpath, code string) error {
+	if rel, err := filepath.Rel(imp.basePath, fpath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside %s", fpath, imp.basePath)
+	}
+	if !imp.overwrite && FileExists(fpath) {
+		return fmt.Errorf("%s exists", fpath)
+	}
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fpath, []byte(code), 0644); err != nil {
+		return err
+	}
+	imp.files = append(imp.files, fpath)
+	return nil
+}
+
+func postmanRequestToLuaCode(item PostmanItem, events []PostmanEvent) (string, error) {
+	req := item.Request
+
+	rawUrl, query, err := parsePostmanUrl(req.Url)
+	if err != nil {
+		return "", err
+	}
+
+	header := make(Params, 0, len(req.Header))
+	for _, kv := range req.Header {
+		if kv.active() {
+			header.Add(FormatHeaderKey(kv.Key), TranslatePostmanVars(kv.Value))
+		}
+	}
+
+	var (
+		data string
+		form Params
+	)
+	if req.Body != nil {
+		switch req.Body.Mode {
+		case "raw":
+			data = req.Body.Raw
+			var buf bytes.Buffer
+			if json.Compact(&buf, []byte(data)) == nil {
+				data = buf.String()
+			}
+			data = TranslatePostmanVars(data)
+		case "urlencoded", "formdata":
+			fields := req.Body.Urlencoded
+			if req.Body.Mode == "formdata" {
+				fields = req.Body.Formdata
+			}
+			// 转换为 context.form，发送时编码并替换其中的 ${var}
+			form = make(Params, 0, len(fields))
+			for _, kv := range fields {
+				if kv.active() {
+					form.Add(TranslatePostmanVars(kv.Key), TranslatePostmanVars(kv.Value))
+				}
+			}
+		}
+	}
+
+	method := strings.ToUpper(req.Method)
+	if method == "" {
+		method = "GET"
+	}
+
+	ctx := map[string]interface{}{
+		"method": method,
+		"url":    rawUrl,
+		"data":   data,
+		"query":  query,
+		"header": header,
+	}
+	if form != nil {
+		ctx["form"] = form
+	}
+	code, err := ToLuaCode(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+
+	buf.WriteString(fmt.Sprintf("-- imported from postman request \"%s\"\n", item.Name))
+	if req.Body != nil && req.Body.Mode == "formdata" {
+		buf.WriteString("-- NOTE: formdata body converted to urlencoded, file fields are not supported\n")
+	}
+	for _, ev := range events {
+		lines := postmanScriptLines(ev.Script.Exec)
+		if len(lines) == 0 {
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("-- TODO: postman %s script, need manual porting\n", ev.Listen))
+		for _, line := range lines {
+			buf.WriteString("-- " + line + "\n")
+		}
+	}
+	buf.WriteString("context = ")
+	buf.WriteString(code)
+	buf.WriteByte('\n')
+	return buf.String(), nil
+}
+
+// parsePostmanUrl 拆分 url 和 query，query 按原有顺序保留重复的 key，key 和 value 已经解码
+func parsePostmanUrl(raw json.RawMessage) (string, Params, error) {
+	query := make(Params, 0)
+	if len(raw) == 0 {
+		return "", query, nil
+	}
+
+	var pu PostmanUrl
+	if err := json.Unmarshal(raw, &pu.Raw); err != nil {
+		if err := json.Unmarshal(raw, &pu); err != nil {
+			return "", nil, err
+		}
+	}
+
+	rawUrl := pu.Raw
+	if idx := strings.Index(rawUrl, "?"); idx >= 0 {
+		// 字符串形式的 url 需要自行拆分 query
+		if len(pu.Query) == 0 {
+			for _, pair := range strings.Split(rawUrl[idx+1:], "&") {
+				if pair == "" {
+					continue
+				}
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) == 1 {
+					kv = append(kv, "")
+				}
+				pu.Query = append(pu.Query, PostmanKeyValue{Key: kv[0], Value: kv[1]})
+			}
+		}
+		rawUrl = rawUrl[:idx]
+	}
+	for _, kv := range pu.Query {
+		if kv.active() {
+			query.Add(queryUnescape(kv.Key), TranslatePostmanVars(queryUnescape(kv.Value)))
+		}
+	}
+	return TranslatePostmanVars(rawUrl), query, nil
+}
+
+func postmanScriptLines(exec json.RawMessage) []string {
+	if len(exec) == 0 {
+		return nil
+	}
+
+	var lines []string
+	if err := json.Unmarshal(exec, &lines); err != nil {
+		var line string
+		if err := json.Unmarshal(exec, &line); err != nil {
+			return nil
+		}
+		lines = strings.Split(line, "\n")
+	}
+
+	res := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
+// postmanFileName 转换为可以用作文件名的名字，只剩下 . 和 _ 的名字（如 ..）使用 defname
+func postmanFileName(name, defname string) string {
+	name = strings.Trim(postmanNameRegexp.ReplaceAllString(strings.TrimSpace(name), "_"), "_")
+	if strings.Trim(name, "._") == "" {
+		return defname
+	}
+	return name
+}
@@ -0,0 +1,238 @@
+package lualib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	PROXY_DIR          = "proxy"
+	PROXY_CA_CERT_FILE = "ca.pem"
+	PROXY_CA_KEY_FILE  = "ca-key.pem"
+	PROXY_MAX_BODY     = 1024 * 1024 // 只记录 body 的前 1MB，超过时标记为截断
+	PROXY_DEFAULT_ADDR = "127.0.0.1:8888"
+)
+
+var (
+	activeProxy   *CaptureProxy
+	activeProxyMu sync.Mutex
+)
+
+// CaptureProxy 本地 http(s) 代理，经过代理的请求和响应记录到 history 中
+// https 请求使用 ~/.icurl/proxy/ca.pem 签发证书解密，需要客户端信任该 CA
+type CaptureProxy struct {
+	Addr   string
+	CAFile string
+	server *http.Server
+}
+
+type proxyCapture struct {
+	req       *HttpContext
+	start     time.Time
+	truncated bool
+}
+
+// StartProxy 启动代理，mitm 为 false 时 https 请求直接转发，不记录
+func StartProxy(listen string, mitm bool) (*CaptureProxy, error) {
+	StopProxy()
+
+	caFile, ca, err := LoadOrCreateProxyCA()
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Logger = log.New(ioutil.Discard, "", 0)
+	if mitm {
+		connect := &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(ca)}
+		proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			return connect, host
+		})
+	}
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		var body []byte
+		if r.Body != nil {
+			body, _ = ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		req, truncated := requestToHttpContext(r, body)
+		ctx.UserData = &proxyCapture{req: req, start: time.Now(), truncated: truncated}
+		return r, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		capture, ok := ctx.UserData.(*proxyCapture)
+		if !ok || resp == nil {
+			return resp
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		respBody, respTruncated := captureBody(decodeContentEncoding(resp.Header.Get("Content-Encoding"), body))
+		entry := DefaultHistory.AddEntry(&HistoryEntry{
+			Request: capture.req,
+			Response: &HttpResponse{
+				StatusCode: resp.StatusCode,
+				Header:     resp.Header,
+				Body:       respBody,
+				Time:       capture.start,
+				Duration:   time.Since(capture.start),
+			},
+			Truncated: capture.truncated || respTruncated,
+		})
+		Diagf("[proxy] %s\n", entry)
+		return resp
+	})
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &CaptureProxy{
+		Addr:   ln.Addr().String(),
+		CAFile: caFile,
+		server: &http.Server{Handler: proxy},
+	}
+	go p.server.Serve(ln)
+
+	activeProxyMu.Lock()
+	activeProxy = p
+	activeProxyMu.Unlock()
+	return p, nil
+}
+
+func StopProxy() bool {
+	activeProxyMu.Lock()
+	p := activeProxy
+	activeProxy = nil
+	activeProxyMu.Unlock()
+
+	if p == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	p.server.Shutdown(ctx)
+	return true
+}
+
+// LoadOrCreateProxyCA 加载 ~/.icurl/proxy/ 下的 CA，不存在时生成
+func LoadOrCreateProxyCA() (string, *tls.Certificate, error) {
+	dir := GetRealPath(filepath.Join(GetBasePath(), PROXY_DIR))
+	certFile := filepath.Join(dir, PROXY_CA_CERT_FILE)
+	keyFile := filepath.Join(dir, PROXY_CA_KEY_FILE)
+
+	if !FileExists(certFile) || !FileExists(keyFile) {
+		if err := createProxyCA(dir, certFile, keyFile); err != nil {
+			return "", nil, err
+		}
+	}
+
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return "", nil, err
+	}
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		return "", nil, err
+	}
+	return certFile, &ca, nil
+}
+
+func createProxyCA(dir, certFile, keyFile string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	host, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "icurl proxy CA " + host, Organization: []string{"icurl"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certFile, certPem, 0644); err != nil {
+		return err
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return ioutil.WriteFile(keyFile, keyPem, 0600)
+}
+
+func PrintProxyInfo(p *CaptureProxy) {
+	Diagf("=== Proxy listening on %s\n", p.Addr)
+	Diagf("=== CA certificate %s\n", p.CAFile)
+}
+
+// requestToHttpContext 转换代理的请求，body 被截断时返回 true
+func requestToHttpContext(r *http.Request, body []byte) (*HttpContext, bool) {
+	httpCtx := NewHttpContext()
+	httpCtx.Method = r.Method
+	httpCtx.Url = r.URL.String()
+	data, truncated := captureBody(body)
+	httpCtx.Data = data
+	httpCtx.Query = make(Params, 0)
+	httpCtx.Header = make(Params, 0)
+	for k, values := range r.Header {
+		// 代理相关和由客户端自动生成的 header 不需要重放
+		if strings.HasPrefix(k, "Proxy-") || k == "Content-Length" || k == "Accept-Encoding" {
+			continue
+		}
+		for _, v := range values {
+			httpCtx.Header.Add(k, v)
+		}
+	}
+	return httpCtx, truncated
+}
+
+func decodeContentEncoding(encoding string, body []byte) []byte {
+	decoded, err := DecodeContentEncoding(encoding, body)
+	if err != nil {
+		return body
+	}
+	return decoded
+}
+
+// captureBody 只保留 body 的前 PROXY_MAX_BODY 字节，截断时返回 true
+func captureBody(body []byte) (string, bool) {
+	if len(body) > PROXY_MAX_BODY {
+		return string(body[:PROXY_MAX_BODY]), true
+	}
+	return string(body), false
+}
@@ -0,0 +1,410 @@
+package lualib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	COLOR_AUTO   = "auto"
+	COLOR_ALWAYS = "always"
+	COLOR_NEVER  = "never"
+
+	DEFAULT_PAGER   = "less -R"
+	PAGER_MIN_LINES = 100 // 超过此行数时使用 pager
+
+	colorReset  = "\033[0m"
+	colorKey    = "\033[34;1m"
+	colorString = "\033[32m"
+	colorNumber = "\033[36m"
+	colorBool   = "\033[33m"
+	colorNull   = "\033[90m"
+	colorTag    = "\033[34m"
+	colorAttr   = "\033[36m"
+)
+
+var (
+	colorMode = COLOR_AUTO
+
+	yamlKeyRegexp = regexp.MustCompile(`^(\s*(?:- )?)([^\s#:][^#:]*?)(:)(\s|$)`)
+)
+
+// SetColorMode 设置输出颜色，auto 时 stdout 为终端才输出颜色，空字符串等同于 auto
+func SetColorMode(mode string) error {
+	if mode == "" {
+		mode = COLOR_AUTO
+	}
+	switch mode {
+	case COLOR_AUTO, COLOR_ALWAYS, COLOR_NEVER:
+		colorMode = mode
+		return nil
+	}
+	return fmt.Errorf("invalid color mode %s, need auto|always|never", mode)
+}
+
+func ColorEnabled() bool {
+	switch colorMode {
+	case COLOR_ALWAYS:
+		return true
+	case COLOR_NEVER:
+		return false
+	}
+	return IsTerminal(os.Stdout)
+}
+
+func IsTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func colorize(s, color string, enabled bool) string {
+	if !enabled || s == "" {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// RenderBody 根据 Content-Type 格式化 body：json、xml、html、yaml、表单，二进制内容输出 hexdump
+func RenderBody(body, contentType string, color bool) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case isBinary(mediaType, body):
+		return hex.Dump([]byte(body))
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return RenderJson(body, color)
+	case mediaType == "text/html":
+		return RenderHtml(body, color)
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		return RenderXml(body, color)
+	case strings.Contains(mediaType, "yaml"):
+		return RenderYaml(body, color)
+	case mediaType == "application/x-www-form-urlencoded":
+		return RenderForm(body, color)
+	}
+
+	// 未指定类型时尝试按 json 格式化
+	if _, ok := ParseJson(body); ok {
+		return RenderJson(body, color)
+	}
+	return body
+}
+
+func isBinary(mediaType, body string) bool {
+	switch {
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "audio/"), strings.HasPrefix(mediaType, "video/"):
+		return true
+	case mediaType == "application/octet-stream", mediaType == "application/pdf", mediaType == "application/zip",
+		mediaType == "application/grpc", mediaType == "application/protobuf", mediaType == "application/x-protobuf":
+		return true
+	}
+	return !utf8.ValidString(body) || strings.ContainsRune(body, 0)
+}
+
+// RenderJson 缩进并高亮 json，无效的 json 原样返回
+func RenderJson(body string, color bool) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(body), "", "    "); err != nil {
+		return body
+	}
+	if !color {
+		return buf.String()
+	}
+	return colorJson(buf.String())
+}
+
+func colorJson(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j++
+			// 字符串后紧跟 ':' 的是 key
+			k := j
+			for k < len(s) && s[k] == ' ' {
+				k++
+			}
+			if k < len(s) && s[k] == ':' {
+				b.WriteString(colorize(s[i:j], colorKey, true))
+			} else {
+				b.WriteString(colorize(s[i:j], colorString, true))
+			}
+			i = j
+		case c == '-' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(s) && strings.IndexByte("0123456789.eE+-", s[j]) >= 0 {
+				j++
+			}
+			b.WriteString(colorize(s[i:j], colorNumber, true))
+			i = j
+		case strings.HasPrefix(s[i:], "true"), strings.HasPrefix(s[i:], "false"):
+			n := 4
+			if c == 'f' {
+				n = 5
+			}
+			b.WriteString(colorize(s[i:i+n], colorBool, true))
+			i += n
+		case strings.HasPrefix(s[i:], "null"):
+			b.WriteString(colorize("null", colorNull, true))
+			i += 4
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// RenderXml 重新缩进 xml，解析失败时原样返回
+func RenderXml(body string, color bool) string {
+	dec := xml.NewDecoder(strings.NewReader(body))
+	dec.Strict = false
+	var buf bytes.Buffer
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "    ")
+	depth := 0
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return body
+		}
+		// 去掉原有的缩进空白，由 encoder 重新缩进
+		if cd, ok := tok.(xml.CharData); ok {
+			if len(bytes.TrimSpace(cd)) == 0 {
+				continue
+			}
+			tok = xml.CharData(bytes.TrimSpace(cd))
+		}
+		if err := enc.EncodeToken(xml.CopyToken(tok)); err != nil {
+			return body
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.ProcInst, xml.Directive, xml.Comment:
+			// encoder 不会在顶层的声明后换行
+			if depth == 0 {
+				if err := enc.Flush(); err != nil {
+					return body
+				}
+				buf.WriteByte('\n')
+			}
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		return body
+	}
+	if !color {
+		return buf.String()
+	}
+	return colorMarkup(buf.String())
+}
+
+var htmlVoidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true,
+}
+
+// RenderHtml 按标签缩进 html，pre、script、style、textarea 中的内容保持原样
+func RenderHtml(body string, color bool) string {
+	z := html.NewTokenizer(strings.NewReader(body))
+	var (
+		b      strings.Builder
+		depth  int
+		rawTag string
+	)
+	line := func(s string) {
+		b.WriteString(strings.Repeat("    ", depth))
+		b.WriteString(s)
+		b.WriteByte('\n')
+	}
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		raw := string(z.Raw())
+		tok := z.Token()
+		if rawTag != "" {
+			if tt == html.EndTagToken && tok.Data == rawTag {
+				rawTag = ""
+				depth--
+				b.WriteString(raw + "\n")
+			} else {
+				b.WriteString(raw)
+			}
+			continue
+		}
+
+		switch tt {
+		case html.StartTagToken:
+			line(raw)
+			if !htmlVoidElements[tok.Data] {
+				depth++
+			}
+			switch tok.Data {
+			case "pre", "script", "style", "textarea":
+				rawTag = tok.Data
+			}
+		case html.EndTagToken:
+			if depth > 0 {
+				depth--
+			}
+			line(raw)
+		case html.TextToken:
+			if s := strings.TrimSpace(raw); s != "" {
+				line(s)
+			}
+		default:
+			line(raw)
+		}
+	}
+	s := strings.TrimRight(b.String(), "\n")
+	if !color {
+		return s
+	}
+	return colorMarkup(s)
+}
+
+var (
+	markupTagRegexp  = regexp.MustCompile(`</?[A-Za-z][^\s/>]*|/?>`)
+	markupAttrRegexp = regexp.MustCompile(`([A-Za-z_:][-A-Za-z0-9_:.]*)=("[^"]*"|'[^']*')`)
+)
+
+// colorMarkup 高亮 xml/html 的标签名和属性
+func colorMarkup(s string) string {
+	var b strings.Builder
+	for len(s) > 0 {
+		start := strings.IndexByte(s, '<')
+		if start < 0 {
+			b.WriteString(s)
+			break
+		}
+		end := strings.IndexByte(s[start:], '>')
+		if end < 0 {
+			b.WriteString(s)
+			break
+		}
+		end += start + 1
+		b.WriteString(s[:start])
+
+		tag := s[start:end]
+		if strings.HasPrefix(tag, "<!") || strings.HasPrefix(tag, "<?") {
+			b.WriteString(colorize(tag, colorNull, true))
+		} else {
+			tag = markupAttrRegexp.ReplaceAllString(tag, colorAttr+"$1"+colorReset+"="+colorString+"$2"+colorReset)
+			tag = markupTagRegexp.ReplaceAllStringFunc(tag, func(t string) string {
+				return colorize(t, colorTag, true)
+			})
+			b.WriteString(tag)
+		}
+		s = s[end:]
+	}
+	return b.String()
+}
+
+// RenderYaml 高亮 yaml 的 key 和注释
+func RenderYaml(body string, color bool) string {
+	if !color {
+		return body
+	}
+	lines := strings.Split(body, "\n")
+	for i, l := range lines {
+		trimmed := strings.TrimSpace(l)
+		switch {
+		case strings.HasPrefix(trimmed, "#"):
+			lines[i] = colorize(l, colorNull, true)
+		case trimmed == "---" || trimmed == "...":
+			lines[i] = colorize(l, colorTag, true)
+		default:
+			lines[i] = yamlKeyRegexp.ReplaceAllString(l, "$1"+colorKey+"$2"+colorReset+"$3$4")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// RenderForm 将 application/x-www-form-urlencoded 输出为两列的表格
+func RenderForm(body string, color bool) string {
+	values, err := url.ParseQuery(strings.TrimSpace(body))
+	if err != nil || len(values) == 0 {
+		return body
+	}
+	keys := make([]string, 0, len(values))
+	width := 0
+	for k := range values {
+		keys = append(keys, k)
+		if n := utf8.RuneCountInString(k); n > width {
+			width = n
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		pad := strings.Repeat(" ", width-utf8.RuneCountInString(k))
+		for _, v := range values[k] {
+			fmt.Fprintf(&b, "%s%s | %s\n", colorize(k, colorKey, color), pad, v)
+		}
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// PrintRendered 输出格式化后的内容，终端中内容较多时使用 $PAGER（默认 less -R）
+// 调用时需要持有 vm 锁，pager 运行期间释放，mock server 和异步回调可以继续执行
+func PrintRendered(s string) {
+	if IsTerminal(os.Stdout) && strings.Count(s, "\n") >= PAGER_MIN_LINES {
+		pager, ok := os.LookupEnv("PAGER")
+		if !ok {
+			pager = DEFAULT_PAGER
+		}
+		if pager != "" {
+			cmd := exec.Command("sh", "-c", pager)
+			cmd.Stdin = strings.NewReader(s + "\n")
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			var err error
+			Unblock(func() { err = cmd.Run() })
+			if err == nil {
+				return
+			}
+		}
+	}
+	fmt.Println(s)
+}
+
+// PrintResponseBody 输出响应 body，render 为 true 时按 Content-Type 格式化，head 模式下不输出
+func PrintResponseBody(resp *HttpResponse, render bool) {
+	if outputMode == OUTPUT_HEAD {
+		return
+	}
+	if !render {
+		fmt.Println(resp.Body)
+		return
+	}
+	PrintRendered(RenderBody(resp.Body, resp.Header.Get("Content-Type"), ColorEnabled()))
+}
@@ -0,0 +1,181 @@
+package lualib
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	RETRY_BACKOFF_CONSTANT    = "constant"
+	RETRY_BACKOFF_LINEAR      = "linear"
+	RETRY_BACKOFF_EXPONENTIAL = "exponential"
+
+	RETRY_DEFAULT_BASE = 200 * time.Millisecond
+	RETRY_DEFAULT_MAX  = 30 * time.Second
+)
+
+var (
+	DefaultRetryOn = []string{"502", "503", "504", "timeout", "connreset"}
+)
+
+// RetryPolicy 重试策略，Attempts 为总的尝试次数
+// On 为重试的状态码或者错误类型（见 ErrorType），POST 默认不重试，除非 AllowPost 或者设置了 Idempotency-Key
+type RetryPolicy struct {
+	Attempts          int
+	Backoff           string
+	Base              time.Duration
+	Max               time.Duration
+	On                []string
+	RespectRetryAfter bool
+	AllowPost         bool
+}
+
+func (p *RetryPolicy) Retryable(ctx *HttpContext) bool {
+	if strings.ToUpper(ctx.Method) != "POST" || p.AllowPost {
+		return true
+	}
+	return ctx.Header.HasFold("Idempotency-Key")
+}
+
+// Match 判断本次结果是否需要重试，返回结果描述
+func (p *RetryPolicy) Match(resp *HttpResponse, err error) (string, bool) {
+	outcome := ErrorType(err)
+	if err == nil {
+		outcome = strconv.Itoa(resp.StatusCode)
+	}
+	for _, on := range p.On {
+		if on == outcome {
+			return outcome, true
+		}
+	}
+	return outcome, false
+}
+
+// Delay 第 attempt 次失败后的等待时间，attempt 从 1 开始
+func (p *RetryPolicy) Delay(attempt int, resp *HttpResponse) time.Duration {
+	if p.RespectRetryAfter && resp != nil {
+		if d, ok := ParseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return p.cap(d)
+		}
+	}
+
+	switch p.Backoff {
+	case RETRY_BACKOFF_CONSTANT:
+		return p.cap(p.Base)
+	case RETRY_BACKOFF_LINEAR:
+		return p.cap(p.Base * time.Duration(attempt))
+	default:
+		return p.cap(time.Duration(float64(p.Base) * math.Pow(2, float64(attempt-1))))
+	}
+}
+
+func (p *RetryPolicy) cap(d time.Duration) time.Duration {
+	if p.Max > 0 && d > p.Max {
+		return p.Max
+	}
+	return d
+}
+
+// ParseRetryAfter 解析秒数或者 http 日期
+func ParseRetryAfter(s string) (time.Duration, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// sendWithRetry 按重试策略调用 do，每次尝试的结果都输出
+func (ctx *HttpContext) sendWithRetry(do func() (*HttpResponse, error)) (*HttpResponse, error) {
+	p := ctx.Retry
+	if p == nil || p.Attempts <= 1 {
+		return do()
+	}
+	if !p.Retryable(ctx) {
+		Diagf("=== Retry disabled for non-idempotent %s, set retry.allow_post or header Idempotency-Key\n", strings.ToUpper(ctx.Method))
+		return do()
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := do()
+		outcome, retry := p.Match(resp, err)
+		if !retry || attempt >= p.Attempts {
+			if attempt > 1 {
+				Diagf("=== Attempt %d/%d: %s\n", attempt, p.Attempts, outcome)
+			}
+			return resp, err
+		}
+
+		delay := p.Delay(attempt, resp)
+		Diagf("=== Attempt %d/%d: %s, retry in %s\n", attempt, p.Attempts, outcome, delay)
+		time.Sleep(delay)
+	}
+}
+
+// LTableToRetryPolicy 解析 {attempts=3, backoff="exponential", base="200ms", max="30s", on={502,503,504,"timeout","connreset"}, respect_retry_after=true, allow_post=false}
+func LTableToRetryPolicy(table *lua.LTable) (*RetryPolicy, error) {
+	p := &RetryPolicy{
+		Attempts:          GetLTableInt(table, "attempts", 3),
+		Backoff:           GetLTableString(table, "backoff", RETRY_BACKOFF_EXPONENTIAL),
+		Base:              RETRY_DEFAULT_BASE,
+		Max:               RETRY_DEFAULT_MAX,
+		On:                DefaultRetryOn,
+		RespectRetryAfter: table.RawGetString("respect_retry_after") != lua.LFalse,
+		AllowPost:         table.RawGetString("allow_post") == lua.LTrue,
+	}
+
+	switch p.Backoff {
+	case RETRY_BACKOFF_CONSTANT, RETRY_BACKOFF_LINEAR, RETRY_BACKOFF_EXPONENTIAL:
+	default:
+		return nil, fmt.Errorf("invalid retry backoff %s, need constant|linear|exponential", p.Backoff)
+	}
+	for field, d := range map[string]*time.Duration{"base": &p.Base, "max": &p.Max} {
+		if s := GetLTableString(table, field); s != "" {
+			v, err := time.ParseDuration(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid retry %s: %v", field, err)
+			}
+			*d = v
+		}
+	}
+	if t := GetLTableTable(table, "on"); t != nil {
+		p.On = LTableToStringSlice(t)
+	}
+	return p, nil
+}
+
+func (p *RetryPolicy) ToLTable(vm *lua.LState) *lua.LTable {
+	table := vm.NewTable()
+	SetLTable(table, "attempts", lua.LNumber(p.Attempts))
+	SetLTableString(table, "backoff", p.Backoff)
+	SetLTableString(table, "base", p.Base.String())
+	SetLTableString(table, "max", p.Max.String())
+	on := vm.NewTable()
+	for _, s := range p.On {
+		if n, err := strconv.Atoi(s); err == nil {
+			on.Append(lua.LNumber(n))
+		} else {
+			on.Append(lua.LString(s))
+		}
+	}
+	SetLTable(table, "on", on)
+	SetLTable(table, "respect_retry_after", lua.LBool(p.RespectRetryAfter))
+	SetLTable(table, "allow_post", lua.LBool(p.AllowPost))
+	return table
+}
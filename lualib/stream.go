@@ -0,0 +1,231 @@
+package lualib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	SSE_DEFAULT_RETRY = 3000 // 重连间隔，毫秒
+)
+
+type SSEEvent struct {
+	Id    string
+	Event string
+	Data  string
+	Retry int
+}
+
+func (ev *SSEEvent) String() string {
+	var buf strings.Builder
+	if ev.Id != "" {
+		buf.WriteString("id: " + ev.Id + "\n")
+	}
+	buf.WriteString("event: " + ev.Event + "\n")
+	for _, line := range strings.Split(ev.Data, "\n") {
+		buf.WriteString("data: " + line + "\n")
+	}
+	if ev.Retry > 0 {
+		buf.WriteString("retry: " + strconv.Itoa(ev.Retry) + "\n")
+	}
+	return buf.String()
+}
+
+func (ev *SSEEvent) ToLTable(vm *lua.LState) *lua.LTable {
+	table := vm.NewTable()
+	SetLTableString(table, "id", ev.Id)
+	SetLTableString(table, "event", ev.Event)
+	SetLTableString(table, "data", ev.Data)
+	SetLTable(table, "retry", lua.LNumber(ev.Retry))
+	if v, ok := ParseJson(ev.Data); ok {
+		SetLTable(table, "json", JsonToLValue(vm, v))
+	}
+	return table
+}
+
+// ReadSSE 按 text/event-stream 格式解析事件，fn 返回 false 时停止
+func ReadSSE(r io.Reader, fn func(ev *SSEEvent) bool) error {
+	reader := bufio.NewReader(r)
+
+	var (
+		data    []string
+		hasData bool
+		ev      = &SSEEvent{}
+	)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		// 空行表示一个事件结束
+		if line == "" {
+			if hasData {
+				ev.Data = strings.Join(data, "\n")
+				if ev.Event == "" {
+					ev.Event = "message"
+				}
+				if !fn(ev) {
+					return nil
+				}
+				ev = &SSEEvent{Id: ev.Id}
+			}
+			// 没有 data 的事件不分发，其中的 retry 保留到下一个事件
+			data, hasData = nil, false
+			ev.Event = ""
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if idx := strings.Index(line, ":"); idx >= 0 {
+			field, value = line[:idx], strings.TrimPrefix(line[idx+1:], " ")
+		}
+		switch field {
+		case "event":
+			ev.Event = value
+		case "data":
+			data = append(data, value)
+			hasData = true
+		case "id":
+			ev.Id = value
+		case "retry":
+			if n, err := strconv.Atoi(value); err == nil {
+				ev.Retry = n
+			}
+		}
+	}
+}
+
+// RunSSE 连接 SSE 服务并将事件写入 out，断开后使用 Last-Event-ID 重连，直到 c 被取消
+func RunSSE(c context.Context, req *HttpContext, reconnect bool, out chan<- *SSEEvent) error {
+	client := streamClient(req)
+	lastId, retry := "", SSE_DEFAULT_RETRY
+
+	for {
+		r, err := req.NewRequest(c)
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Accept", "text/event-stream")
+		r.Header.Set("Cache-Control", "no-cache")
+		if lastId != "" {
+			r.Header.Set("Last-Event-ID", lastId)
+		}
+
+		resp, err := client.Do(r)
+		if err == nil {
+			if resp.StatusCode != http.StatusOK {
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				return fmt.Errorf("status code %d: %s", resp.StatusCode, body)
+			}
+
+			Diagf("=== Connected to %s, status code: %d\n", r.URL, resp.StatusCode)
+			err = ReadSSE(resp.Body, func(ev *SSEEvent) bool {
+				lastId = ev.Id
+				if ev.Retry > 0 {
+					retry = ev.Retry
+				}
+				select {
+				case out <- ev:
+					return true
+				case <-c.Done():
+					return false
+				}
+			})
+			resp.Body.Close()
+		}
+
+		if c.Err() != nil {
+			return nil
+		}
+		if !reconnect {
+			return err
+		}
+		if err != nil {
+			Diagf("=== Disconnected: %v\n", err)
+		}
+		Diagf("=== Reconnect in %dms, Last-Event-ID: %s\n", retry, lastId)
+
+		select {
+		case <-time.After(time.Duration(retry) * time.Millisecond):
+		case <-c.Done():
+			return nil
+		}
+	}
+}
+
+// RunStream 逐行读取响应并写入 out，用于 chunked 等流式响应
+func RunStream(c context.Context, req *HttpContext, out chan<- string) error {
+	r, err := req.NewRequest(c)
+	if err != nil {
+		return err
+	}
+	resp, err := streamClient(req).Do(r)
+	if err != nil {
+		if c.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	Diagf("=== Connected to %s, status code: %d\n", r.URL, resp.StatusCode)
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			select {
+			case out <- strings.TrimRight(line, "\r\n"):
+			case <-c.Done():
+				return nil
+			}
+		}
+		if err != nil {
+			if err == io.EOF || c.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// 流式请求不设置超时，由 Ctrl-C 或回调结束
+func streamClient(req *HttpContext) *http.Client {
+	client := &http.Client{}
+	if req.Transport != nil {
+		client.Transport = req.Transport
+	} else if t := req.NewTransport(); t != nil {
+		client.Transport = t
+	}
+	return client
+}
+
+// CallStreamCallback 调用流式回调函数，返回值留在栈顶，调用方需要 Pop
+func CallStreamCallback(vm *lua.LState, fn *lua.LFunction, arg lua.LValue) error {
+	err := vm.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    1,
+		Protect: true,
+	}, arg)
+	if err != nil {
+		vm.Push(lua.LNil)
+	}
+	return err
+}
@@ -4,16 +4,22 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
-	"strconv"
+	"regexp"
 	"strings"
 
 	"github.com/yuin/gopher-lua"
 )
 
+var (
+	varRegexp = regexp.MustCompile(`\$\{([A-Za-z0-9_.\-]+)\}`)
+)
+
 func CheckArg(vm *lua.LState, narg int, errmsg string) bool {
 	if vm.GetTop() < narg {
 		vm.RaiseError(errmsg)
@@ -89,6 +95,16 @@ func IsLetter(b byte) bool {
 	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
 }
 
+// StringIsIdent 是否是合法的标识符，由字母、数字、下划线组成，不以数字开头
+func StringIsIdent(s string) bool {
+	for i, j := 0, len(s); i < j; i++ {
+		if !IsLetter(s[i]) && s[i] != '_' && !(i > 0 && s[i] >= '0' && s[i] <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
 func UcFirst(s string) string {
 	if s == "" {
 		return ""
@@ -125,7 +141,7 @@ func FormatHeaderKey(s string) string {
 }
 
 func LTableToJsonString(table *lua.LTable, formatJson bool) (string, error) {
-	m, err := LTableToMap(table)
+	m, err := LValueToJsonValue(table)
 	if err != nil {
 		return "", err
 	}
@@ -144,57 +160,61 @@ func LTableToJsonString(table *lua.LTable, formatJson bool) (string, error) {
 	}
 }
 
+// LTableToMap 转换为 json 对象，值的转换规则见 LValueToJsonValue
 func LTableToMap(table *lua.LTable) (map[string]interface{}, error) {
-	jsonMap := make(map[string]interface{})
+	v, err := LValueToJsonValue(table)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("table is an array, object expected")
+	}
+	return m, nil
+}
 
-	tableMap := make(map[lua.LValue]lua.LValue)
-	table.ForEach(func(tk, tv lua.LValue) {
-		tableMap[tk] = tv
-	})
+// LValueToJsonBody 编码为 json 请求 body，并替换字符串中的 ${var}
+func LValueToJsonBody(v lua.LValue, vars map[string]string) (string, error) {
+	jv, err := LValueToJsonValue(v)
+	if err != nil {
+		return "", err
+	}
+	bytes, err := json.Marshal(expandJsonVars(jv, vars))
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
 
-	for k, v := range tableMap {
-		if tk, ok := k.(lua.LString); ok {
-			sk := string(tk)
-			var sv interface{}
-
-			switch v := v.(type) {
-			case lua.LBool:
-				sv = bool(v)
-			case lua.LNumber:
-				sv = float64(v)
-			case lua.LString:
-				sv = string(v)
-			case *lua.LNilType:
-				sv = nil
-			case *lua.LTable:
-				ssv, err := LTableToMap(v)
-				if err != nil {
-					return nil, err
-				}
-				sv = ssv
-			default:
-				return nil, errors.New("table value only supported type of bool|number|string|nil|table")
-			}
-
-			jsonMap[sk] = sv
-		} else {
-			return nil, errors.New("table key only supported string type")
+func expandJsonVars(v interface{}, vars map[string]string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return ExpandVars(v, vars)
+	case []interface{}:
+		for i := range v {
+			v[i] = expandJsonVars(v[i], vars)
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = expandJsonVars(v[k], vars)
 		}
 	}
+	return v
+}
 
-	return jsonMap, nil
+func countLTableKeys(table *lua.LTable) int {
+	n := 0
+	table.ForEach(func(_, _ lua.LValue) {
+		n++
+	})
+	return n
 }
 
-func JsonPrettyFormat(s string) string {
-	var holder interface{}
-	if err := json.Unmarshal([]byte(s), &holder); err != nil {
-		return s
+func PrintBody(body string, formatJson bool) {
+	if formatJson {
+		PrintRendered(RenderJson(body, ColorEnabled()))
 	} else {
-		if bytes, err := json.MarshalIndent(&holder, "", "    "); err != nil {
-			return s
-		} else {
-			return string(bytes)
-		}
+		fmt.Println(body)
 	}
 }
 
@@ -209,69 +229,94 @@ func LTableToMapString(table *lua.LTable) map[string]string {
 	return res
 }
 
-func LTableToLuaCode(table *lua.LTable) (string, error) {
-	maps, err := LTableToMap(table)
-	if err != nil {
-		return "", err
+func LTableToStringSlice(table *lua.LTable) []string {
+	res := make([]string, 0)
+
+	if table != nil {
+		table.ForEach(func(_, v lua.LValue) {
+			res = append(res, v.String())
+		})
 	}
+	return res
+}
 
-	s, err := MapToLuaCode(maps, "\t")
-	if err != nil {
-		return "", err
+func MapStringToLTable(vm *lua.LState, m map[string]string) *lua.LTable {
+	table := vm.NewTable()
+	for k, v := range m {
+		SetLTableString(table, k, v)
 	}
+	return table
+}
 
-	return s, nil
+// JsonToLValue 将 json 解析结果转换为 lua 值，json 数组转换为 lua 数组
+func JsonToLValue(vm *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case json.Number:
+		f, _ := v.Float64()
+		return lua.LNumber(f)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		table := vm.NewTable()
+		for _, item := range v {
+			table.Append(JsonToLValue(vm, item))
+		}
+		return table
+	case map[string]interface{}:
+		table := vm.NewTable()
+		for k, item := range v {
+			table.RawSetString(k, JsonToLValue(vm, item))
+		}
+		return table
+	default:
+		return lua.LNil
+	}
 }
 
-func MapToLuaCode(m map[string]interface{}, prefix string) (string, error) {
-	if len(m) <= 0 {
-		return "{}", nil
+// ExpandVars 替换字符串中的 ${var}，未定义的变量保持原样
+func ExpandVars(s string, vars map[string]string) string {
+	if len(vars) == 0 || !strings.Contains(s, "${") {
+		return s
 	}
+	return varRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		if v, ok := vars[m[2:len(m)-1]]; ok {
+			return v
+		}
+		return m
+	})
+}
 
-	var buf bytes.Buffer
+func ExpandMapVars(m map[string]string, vars map[string]string) map[string]string {
+	for k, v := range m {
+		m[k] = ExpandVars(v, vars)
+	}
+	return m
+}
 
-	buf.WriteString("{\n")
-	for key, val := range m {
-		// handle key
-		buf.WriteString(prefix)
-		if StringIsLetter(key) {
-			buf.WriteString(key)
-		} else {
-			buf.WriteString(`["`)
-			buf.WriteString(key)
-			buf.WriteString(`"]`)
-		}
-		buf.WriteString(" = ")
-		// handle value
-		if s, ok := val.(string); ok {
-			buf.WriteByte('"')
-			buf.WriteString(strings.Replace(s, `"`, `\"`, -1))
-			buf.WriteByte('"')
-		} else if f, ok := val.(float64); ok {
-			buf.WriteString(strconv.FormatFloat(f, 'f', -1, 64))
-		} else if val == nil {
-			buf.WriteString("nil")
-		} else if b, ok := val.(bool); ok {
-			if b {
-				buf.WriteString("true")
-			} else {
-				buf.WriteString("false")
-			}
-		} else if mm, ok := val.(map[string]interface{}); ok {
-			str, err := MapToLuaCode(mm, prefix+"\t")
-			if err != nil {
-				return "", err
-			}
-			buf.WriteString(str)
-		} else {
-			return "", errors.New("table value only supported type of bool|number|string|nil|table")
+// OnInterrupt 收到 Ctrl-C 时调用 fn，而不是退出程序，返回的函数用于取消监听
+func OnInterrupt(fn func()) func() {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, os.Interrupt)
+
+	go func() {
+		select {
+		case <-ch:
+			fn()
+		case <-done:
 		}
-		buf.WriteByte(',')
-		buf.WriteByte('\n')
+	}()
+
+	return func() {
+		signal.Stop(ch)
+		close(done)
 	}
-	buf.WriteString(prefix)
-	buf.WriteByte('}')
-	return buf.String(), nil
 }
 
 func ShellExec(cmd string) (string, error) {
@@ -0,0 +1,397 @@
+package lualib
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	WS_PROMPT        = "ws> "
+	WS_CONN_TYPE     = "ws_conn"
+	WS_QUEUE_SIZE    = 1024
+	WS_WRITE_TIMEOUT = 3 * time.Second
+)
+
+type WsMessage struct {
+	Type string // text|binary|ping|pong|close
+	Data string
+	Code int // close code
+}
+
+func (msg *WsMessage) String() string {
+	switch msg.Type {
+	case "binary":
+		return fmt.Sprintf("< binary(%d)\n%s", len(msg.Data), strings.TrimRight(hex.Dump([]byte(msg.Data)), "\n"))
+	case "close":
+		return fmt.Sprintf("< close %d %s", msg.Code, msg.Data)
+	default:
+		return fmt.Sprintf("< %s: %s", msg.Type, msg.Data)
+	}
+}
+
+func (msg *WsMessage) ToLTable(vm *lua.LState) *lua.LTable {
+	table := vm.NewTable()
+	SetLTableString(table, "type", msg.Type)
+	SetLTableString(table, "data", msg.Data)
+	if msg.Type == "close" {
+		SetLTable(table, "code", lua.LNumber(msg.Code))
+	}
+	if msg.Type == "text" {
+		if v, ok := ParseJson(msg.Data); ok {
+			SetLTable(table, "json", JsonToLValue(vm, v))
+		}
+	}
+	return table
+}
+
+type WsOptions struct {
+	Header       Params
+	Subprotocols []string
+	OnMessage    *lua.LFunction
+}
+
+// LTableToWsOptions 解析 {headers = {}, subprotocols = {}, on_message = function(msg) end}
+func LTableToWsOptions(table *lua.LTable) WsOptions {
+	var opts WsOptions
+	if t := GetLTableTable(table, "headers"); t != nil {
+		opts.Header = LTableToParams(t)
+	}
+	if t := GetLTableTable(table, "subprotocols"); t != nil {
+		opts.Subprotocols = LTableToStringSlice(t)
+	}
+	opts.OnMessage, _ = table.RawGetString("on_message").(*lua.LFunction)
+	return opts
+}
+
+// WsConn websocket 连接，收到的消息交给 handler，未设置 handler 时放入队列由 Recv 读取
+// handler 在读取 goroutine 中执行
+type WsConn struct {
+	Url     string
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	handler func(c *WsConn, msg *WsMessage)
+	queue   chan *WsMessage
+	done    chan struct{}
+}
+
+func DialWs(url string, header Params, subprotocols []string, handler func(c *WsConn, msg *WsMessage)) (*WsConn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = 3 * time.Second
+	dialer.Subprotocols = subprotocols
+
+	h := http.Header{}
+	header.ApplyHeader(h)
+
+	conn, resp, err := dialer.Dial(url, h)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%v, status code: %d", err, resp.StatusCode)
+		}
+		return nil, err
+	}
+
+	c := &WsConn{
+		Url:     url,
+		conn:    conn,
+		handler: handler,
+		queue:   make(chan *WsMessage, WS_QUEUE_SIZE),
+		done:    make(chan struct{}),
+	}
+	conn.SetPingHandler(func(data string) error {
+		c.dispatch(&WsMessage{Type: "ping", Data: data})
+		return c.write(websocket.PongMessage, []byte(data))
+	})
+	conn.SetPongHandler(func(data string) error {
+		c.dispatch(&WsMessage{Type: "pong", Data: data})
+		return nil
+	})
+	go c.readLoop()
+	return c, nil
+}
+
+// Subprotocol 返回服务端选择的子协议
+func (c *WsConn) Subprotocol() string {
+	return c.conn.Subprotocol()
+}
+
+func (c *WsConn) readLoop() {
+	defer close(c.done)
+	defer close(c.queue)
+
+	for {
+		typ, data, err := c.conn.ReadMessage()
+		if err != nil {
+			msg := &WsMessage{Type: "close", Code: websocket.CloseAbnormalClosure, Data: err.Error()}
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				msg.Code, msg.Data = closeErr.Code, closeErr.Text
+			}
+			c.dispatch(msg)
+			c.conn.Close()
+			return
+		}
+
+		switch typ {
+		case websocket.TextMessage:
+			c.dispatch(&WsMessage{Type: "text", Data: string(data)})
+		case websocket.BinaryMessage:
+			c.dispatch(&WsMessage{Type: "binary", Data: string(data)})
+		}
+	}
+}
+
+func (c *WsConn) dispatch(msg *WsMessage) {
+	if c.handler != nil {
+		c.handler(c, msg)
+		return
+	}
+	select {
+	case c.queue <- msg:
+	default:
+		// 队列满时丢弃最早的消息
+		select {
+		case <-c.queue:
+		default:
+		}
+		c.queue <- msg
+	}
+}
+
+func (c *WsConn) write(typ int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	deadline := time.Now().Add(WS_WRITE_TIMEOUT)
+	if typ == websocket.PingMessage || typ == websocket.PongMessage || typ == websocket.CloseMessage {
+		return c.conn.WriteControl(typ, data, deadline)
+	}
+	c.conn.SetWriteDeadline(deadline)
+	return c.conn.WriteMessage(typ, data)
+}
+
+func (c *WsConn) SendText(s string) error {
+	return c.write(websocket.TextMessage, []byte(s))
+}
+
+func (c *WsConn) SendBinary(b []byte) error {
+	return c.write(websocket.BinaryMessage, b)
+}
+
+func (c *WsConn) Ping(data string) error {
+	return c.write(websocket.PingMessage, []byte(data))
+}
+
+// Close 发送 close 帧并等待服务端关闭连接
+func (c *WsConn) Close(code int, reason string) error {
+	if c.Closed() {
+		return nil
+	}
+	err := c.write(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+	select {
+	case <-c.done:
+	case <-time.After(WS_WRITE_TIMEOUT):
+		c.conn.Close()
+	}
+	return err
+}
+
+func (c *WsConn) Closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Recv 读取队列中的下一条消息，timeout 为 0 时一直等待，连接关闭后返回 nil
+func (c *WsConn) Recv(timeout time.Duration) (*WsMessage, bool) {
+	var after <-chan time.Time
+	if timeout > 0 {
+		after = time.After(timeout)
+	}
+	select {
+	case msg, ok := <-c.queue:
+		return msg, ok
+	case <-after:
+		return nil, true
+	}
+}
+
+// RunWsCommand 执行交互模式中的命令，/ping [data]、/binary <hex>、/close [code] [reason]，其他作为文本发送
+// 返回 true 表示退出交互模式
+func (c *WsConn) RunWsCommand(line string) (bool, error) {
+	if !strings.HasPrefix(line, "/") {
+		return false, c.SendText(line)
+	}
+
+	fields := strings.SplitN(line, " ", 2)
+	arg := ""
+	if len(fields) > 1 {
+		arg = fields[1]
+	}
+	switch fields[0] {
+	case "/ping":
+		return false, c.Ping(arg)
+	case "/binary":
+		b, err := hex.DecodeString(strings.Replace(arg, " ", "", -1))
+		if err != nil {
+			return false, err
+		}
+		return false, c.SendBinary(b)
+	case "/close", "/quit":
+		code, reason := websocket.CloseNormalClosure, ""
+		if arg != "" {
+			parts := strings.SplitN(arg, " ", 2)
+			n, err := strconv.Atoi(parts[0])
+			if err != nil {
+				return false, fmt.Errorf("invalid close code %s", parts[0])
+			}
+			code = n
+			if len(parts) > 1 {
+				reason = parts[1]
+			}
+		}
+		return true, c.Close(code, reason)
+	case "/text":
+		return false, c.SendText(arg)
+	default:
+		return false, fmt.Errorf("unknown command %s, supported /ping [data], /binary <hex>, /text <string>, /close [code] [reason]", fields[0])
+	}
+}
+
+// WsUrl 将 http(s) 地址转换为 ws(s) 地址
+func WsUrl(url string) string {
+	if strings.HasPrefix(url, "http://") {
+		return "ws://" + url[len("http://"):]
+	}
+	if strings.HasPrefix(url, "https://") {
+		return "wss://" + url[len("https://"):]
+	}
+	return url
+}
+
+// WsMessageHandler 打印收到的消息，并在持有虚拟机锁时调用 on_message，回调返回 false 时关闭连接
+func WsMessageHandler(vm *lua.LState, fn *lua.LFunction, print bool) func(c *WsConn, msg *WsMessage) {
+	return func(c *WsConn, msg *WsMessage) {
+		if print {
+			fmt.Println(msg)
+		}
+		if fn == nil {
+			return
+		}
+
+		LockVM()
+		defer UnlockVM()
+
+		err := CallStreamCallback(vm, fn, msg.ToLTable(vm))
+		ret := vm.Get(-1)
+		vm.Pop(1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ws on_message error: %v\n", err)
+		} else if ret == lua.LFalse && msg.Type != "close" {
+			// 在读取 goroutine 中不能等待连接关闭
+			go c.Close(websocket.CloseNormalClosure, "")
+		}
+	}
+}
+
+func RegisterWsType(vm *lua.LState) {
+	mt := vm.NewTypeMetatable(WS_CONN_TYPE)
+	vm.SetField(mt, "__index", vm.SetFuncs(vm.NewTable(), map[string]lua.LGFunction{
+		"send":        wsConnSend,
+		"send_binary": wsConnSendBinary,
+		"ping":        wsConnPing,
+		"recv":        wsConnRecv,
+		"close":       wsConnClose,
+	}))
+}
+
+func NewWsConnUserData(vm *lua.LState, c *WsConn) *lua.LUserData {
+	ud := vm.NewUserData()
+	ud.Value = c
+	vm.SetMetatable(ud, vm.GetTypeMetatable(WS_CONN_TYPE))
+	return ud
+}
+
+func checkWsConn(vm *lua.LState) *WsConn {
+	ud := vm.CheckUserData(1)
+	if c, ok := ud.Value.(*WsConn); ok {
+		return c
+	}
+	vm.ArgError(1, "ws connection expected")
+	return nil
+}
+
+func wsConnSend(vm *lua.LState) int {
+	c := checkWsConn(vm)
+	if err := c.SendText(vm.CheckString(2)); err != nil {
+		vm.RaiseError("ws send error: %v", err)
+	}
+	return 0
+}
+
+func wsConnSendBinary(vm *lua.LState) int {
+	c := checkWsConn(vm)
+	if err := c.SendBinary([]byte(vm.CheckString(2))); err != nil {
+		vm.RaiseError("ws send error: %v", err)
+	}
+	return 0
+}
+
+func wsConnPing(vm *lua.LState) int {
+	c := checkWsConn(vm)
+	if err := c.Ping(vm.OptString(2, "")); err != nil {
+		vm.RaiseError("ws ping error: %v", err)
+	}
+	return 0
+}
+
+func wsConnRecv(vm *lua.LState) int {
+	c := checkWsConn(vm)
+
+	var timeout time.Duration
+	if s := vm.OptString(2, ""); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			vm.ArgError(2, err.Error())
+			return 0
+		}
+		timeout = d
+	}
+
+	var (
+		msg *WsMessage
+		ok  bool
+	)
+	Unblock(func() { msg, ok = c.Recv(timeout) })
+	if !ok || msg == nil {
+		vm.Push(lua.LNil)
+		return 1
+	}
+	vm.Push(msg.ToLTable(vm))
+	return 1
+}
+
+func wsConnClose(vm *lua.LState) int {
+	c := checkWsConn(vm)
+	code := vm.OptInt(2, websocket.CloseNormalClosure)
+	reason := vm.OptString(3, "")
+
+	var err error
+	Unblock(func() { err = c.Close(code, reason) })
+	if err != nil {
+		vm.RaiseError("ws close error: %v", err)
+	}
+	return 0
+}
@@ -27,6 +27,14 @@ const (
 You can get help information through the help() function.`
 )
 
+// GetPrompt 不是默认 context 时在提示符中显示当前 context 的名字
+func GetPrompt() string {
+	if name := lualib.ActiveContext(); name != lualib.DEFAULT_CONTEXT {
+		return fmt.Sprintf("icurl[%s]> ", name)
+	}
+	return DEFAULT_PROMPT
+}
+
 func OpenHistoryFile() *os.File {
 	f, err := os.OpenFile(lualib.GetRealPath(DEFAULT_HISTORY_FILE), os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
@@ -58,17 +66,23 @@ func CommandCompleter(line string) []string {
 			candidates = append(candidates, name)
 		}
 	}
-	return candidates
+	// 使用已加载的 graphql schema 补全类型和字段
+	return append(candidates, lualib.GraphqlCompleter(line)...)
 }
 
 func main() {
-	commandOptions := &CommandOptions{}
-	eflag.Parse(commandOptions)
-
 	// Lua VM
 	vm := lua.NewState()
 	defer vm.Close()
+	lualib.LockVM()
 	ErrExit(lualib.Init(vm))
+
+	if RunSubCommand(vm) {
+		return
+	}
+
+	commandOptions := &CommandOptions{}
+	eflag.Parse(commandOptions)
 	RunWithCommandOptions(vm, commandOptions)
 
 	historyFile := OpenHistoryFile()
@@ -82,6 +96,7 @@ func main() {
 	lineState.SetMultiLineMode(true)
 	lineState.SetTabCompletionStyle(liner.TabPrints)
 	lineState.SetCompleter(CommandCompleter)
+	lualib.Prompter = lineState.Prompt
 	_, err := lineState.ReadHistory(historyFile)
 	if err != nil {
 		ErrExit(err)
@@ -90,7 +105,9 @@ func main() {
 	// Main loop
 	fmt.Println(LOGO_PROMPT)
 	for {
-		line, err := lineState.Prompt(DEFAULT_PROMPT)
+		lualib.UnlockVM()
+		line, err := lineState.Prompt(GetPrompt())
+		lualib.LockVM()
 		if err == liner.ErrPromptAborted {
 			break
 		} else if err != nil {
@@ -109,7 +126,8 @@ func main() {
 
 		// Run shell command
 		if line[0] == '!' {
-			str, err := lualib.ShellExec(line[1:])
+			var str string
+			lualib.Unblock(func() { str, err = lualib.ShellExec(line[1:]) })
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "run shell command error: %v\n", err)
 			} else {
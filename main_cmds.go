@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/luoyecb/icurl/lualib"
+
+	"github.com/luoyecb/eflag"
+	"github.com/yuin/gopher-lua"
+)
+
+var (
+	// 子命令，如 icurl diff -a staging -b production
+	// 返回 true 时子命令执行完后进入交互模式
+	SubCommands = map[string]func(vm *lua.LState) bool{
+		"diff":  RunDiffCommand,
+		"bench": RunBenchCommand,
+		"proxy": RunProxyCommand,
+	}
+)
+
+// RunSubCommand 执行子命令，返回 true 表示需要退出
+func RunSubCommand(vm *lua.LState) bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+	cmd, ok := SubCommands[os.Args[1]]
+	if !ok {
+		return false
+	}
+
+	// 去掉子命令名称，剩余参数交给子命令解析
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	return !cmd(vm)
+}
+
+// LoadCommandContext 加载子命令的 context，-f 指定的文件优先，-url 覆盖 context.url
+func LoadCommandContext(vm *lua.LState, filename, url string) {
+	if filename != "" {
+		if !lualib.FileExists(filename) {
+			fmt.Fprintf(os.Stderr, "file %s not exists.", filename)
+			os.Exit(1)
+		}
+		ErrExit(lualib.RunLuaFile(vm, filename))
+	}
+	if url != "" {
+		ctx, ok := lualib.GetContext(vm)
+		if !ok {
+			ErrExit(fmt.Errorf("context must be table"))
+		}
+		lualib.SetLTableString(ctx, "url", url)
+	}
+}
+
+type DiffCommandOptions struct {
+	Filename string   `flag:"f,,lua file which sets context"`
+	Url      string   `flag:"url,,request url, override context.url"`
+	EnvA     string   `flag:"a,,env name or base url A"`
+	EnvB     string   `flag:"b,,env name or base url B"`
+	Ignore   []string `flag:"ignore,,extra ignore rules, separated by @"`
+}
+
+func RunDiffCommand(vm *lua.LState) bool {
+	opts := &DiffCommandOptions{}
+	eflag.Parse(opts)
+	LoadCommandContext(vm, opts.Filename, opts.Url)
+
+	ctx, _ := lualib.GetContext(vm)
+	res, err := lualib.Compare(vm, ctx, opts.EnvA, opts.EnvB, opts.Ignore)
+	ErrExit(err)
+
+	fmt.Println(res)
+	if !res.Same() {
+		os.Exit(1)
+	}
+	return false
+}
+
+type BenchCommandOptions struct {
+	Filename    string        `flag:"f,,lua file which sets context"`
+	Url         string        `flag:"url,,request url, override context.url"`
+	N           int           `flag:"n,0,number of requests"`
+	Concurrency int           `flag:"c,10,number of concurrent workers"`
+	Duration    time.Duration `flag:"duration,0s,duration of benchmark, e.g. 30s"`
+	Rate        int           `flag:"rate,0,requests per second, 0 means unlimited"`
+	Output      string        `flag:"o,,output file, .csv for every request, .json for summary"`
+}
+
+func RunBenchCommand(vm *lua.LState) bool {
+	opts := &BenchCommandOptions{}
+	eflag.Parse(opts)
+	LoadCommandContext(vm, opts.Filename, opts.Url)
+
+	ctx, _ := lualib.GetContext(vm)
+	req, err := lualib.ContextToHttpContext(ctx, lualib.GetVars(vm))
+	ErrExit(err)
+	res := lualib.Bench(req, lualib.BenchOptions{
+		N:           opts.N,
+		Concurrency: opts.Concurrency,
+		Duration:    opts.Duration,
+		Rate:        opts.Rate,
+	})
+
+	fmt.Println(res)
+	if opts.Output != "" {
+		ErrExit(res.WriteFile(opts.Output))
+	}
+	return false
+}
+
+type ProxyCommandOptions struct {
+	Listen string `flag:"listen,127.0.0.1:8888,proxy listen address"`
+	Mitm   bool   `flag:"mitm,true,decrypt https with icurl CA"`
+}
+
+func RunProxyCommand(vm *lua.LState) bool {
+	opts := &ProxyCommandOptions{}
+	eflag.Parse(opts)
+
+	p, err := lualib.StartProxy(opts.Listen, opts.Mitm)
+	ErrExit(err)
+	lualib.PrintProxyInfo(p)
+	return true
+}
@@ -17,15 +17,45 @@ type CommandOptions struct {
 	Data     string            `flag:"d,,request data"`
 	Query    map[string]string `flag:"q,,request data"`
 	Header   map[string]string `flag:"h,,http headers"`
+	Import   string            `flag:"import,,import postman collection or environment file"`
+
+	UnixSocket  string   `flag:"unix-socket,,send requests through this unix socket"`
+	Resolve     []string `flag:"resolve,,resolve host:port to addr, host:port:addr, separated by @"`
+	HttpVersion string   `flag:"http-version,,http version, auto|1.1|2|h2c"`
+
+	Color  string `flag:"color,auto,colorize formatted output, auto|always|never"`
+	Output string `flag:"output,default,output mode, default|silent|include|head|verbose, like curl -s|-i|-I|-v"`
+
+	Cassette     string `flag:"cassette,,record or replay requests with this cassette"`
+	CassetteMode string `flag:"cassette-mode,auto,cassette mode, record|replay|auto"`
 }
 
 func RunWithCommandOptions(vm *lua.LState, cmdOpts *CommandOptions) {
-	if cmdOpts.Filename != "" {
+	ErrExit(lualib.SetColorMode(cmdOpts.Color))
+	ErrExit(lualib.SetOutputMode(cmdOpts.Output))
+
+	if cmdOpts.Cassette != "" {
+		c, err := lualib.OpenCassette(cmdOpts.Cassette, lualib.CassetteOptions{Mode: cmdOpts.CassetteMode})
+		ErrExit(err)
+		lualib.UseCassette(c)
+	}
+
+	if cmdOpts.Import != "" {
+		files, err := lualib.ImportPostman(lualib.GetRealPath(cmdOpts.Import), false)
+		for _, f := range files {
+			fmt.Println(f)
+		}
+		ErrExit(err)
+		os.Exit(0)
+	} else if cmdOpts.Filename != "" {
 		if !lualib.FileExists(cmdOpts.Filename) {
 			fmt.Fprintf(os.Stderr, "file %s not exists.", cmdOpts.Filename)
 			os.Exit(1)
 		}
-		lualib.RunLuaFile(vm, cmdOpts.Filename)
+		if err := lualib.RunLuaFile(vm, cmdOpts.Filename); err != nil {
+			fmt.Fprintf(os.Stderr, "run lua error: %v\n", err)
+			os.Exit(1)
+		}
 		os.Exit(0)
 	} else {
 		codes := make([]string, 0)
@@ -43,6 +73,21 @@ func RunWithCommandOptions(vm *lua.LState, cmdOpts *CommandOptions) {
 				codes = append(codes, fmt.Sprintf(`set_header("%s", "%s")`, key, val))
 			}
 		}
+		if cmdOpts.UnixSocket != "" {
+			codes = append(codes, fmt.Sprintf(`context.unix_socket = "%s"`, cmdOpts.UnixSocket))
+		}
+		if cmdOpts.HttpVersion != "" {
+			codes = append(codes, fmt.Sprintf(`context.http_version = "%s"`, cmdOpts.HttpVersion))
+		}
+		resolve := make([]string, 0)
+		for _, r := range cmdOpts.Resolve {
+			if r != "" {
+				resolve = append(resolve, fmt.Sprintf(`"%s"`, r))
+			}
+		}
+		if len(resolve) > 0 {
+			codes = append(codes, fmt.Sprintf(`context.resolve = {%s}`, strings.Join(resolve, ", ")))
+		}
 		if len(cmdOpts.Query) > 0 {
 			for key, val := range cmdOpts.Query {
 				codes = append(codes, fmt.Sprintf(`set_query("%s", "%s")`, key, val))